@@ -0,0 +1,149 @@
+package dynstruct
+
+import (
+	stdjson "encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// CanonicalJSON encodes v as RFC 8785 (JCS) canonical JSON: the keys of all
+// the objects are sorted, numbers are formatted as ECMAScript does and
+// strings are escaped minimally, so that equal Values encode to the same
+// bytes whatever the order their fields are declared in. As numbers are
+// IEEE 754 doubles in JCS, integers beyond 2^53 may lose precision.
+func (v Value) CanonicalJSON() ([]byte, error) {
+	data, err := v.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return canonicalize(nil, data, v.t.codec)
+}
+
+// canonicalize appends the canonical form of the JSON data to dst, parsed
+// with codec.
+func canonicalize(dst, data []byte, codec Codec) ([]byte, error) {
+	var doc interface{}
+	if err := codecOf(codec).Unmarshal(data, &doc, DecodeOptions{UseNumber: true}); err != nil {
+		return nil, err
+	}
+	return appendCanonical(dst, doc)
+}
+
+func appendCanonical(dst []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		return append(dst, "null"...), nil
+	case bool:
+		return strconv.AppendBool(dst, v), nil
+	case stdjson.Number:
+		return appendCanonicalNumber(dst, string(v))
+	case string:
+		return appendCanonicalString(dst, v), nil
+	case []interface{}:
+		dst = append(dst, '[')
+		for i, elem := range v {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			if dst, err = appendCanonical(dst, elem); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, ']'), nil
+	default: // the objects decoded
+		obj := v.(map[string]interface{})
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sortUTF16(keys)
+		dst = append(dst, '{')
+		for i, k := range keys {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendCanonicalString(dst, k)
+			dst = append(dst, ':')
+			if dst, err = appendCanonical(dst, obj[k]); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, '}'), nil
+	}
+}
+
+// sortUTF16 sorts keys by their UTF-16 code units, as JCS requires.
+func sortUTF16(keys []string) {
+	units := make(map[string][]uint16, len(keys))
+	for _, k := range keys {
+		units[k] = utf16.Encode([]rune(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := units[keys[i]], units[keys[j]]
+		for n := 0; n < len(a) && n < len(b); n++ {
+			if a[n] != b[n] {
+				return a[n] < b[n]
+			}
+		}
+		return len(a) < len(b)
+	})
+}
+
+// appendCanonicalNumber formats the number s like ECMAScript's
+// Number.prototype.toString does.
+func appendCanonicalNumber(dst []byte, s string) ([]byte, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, makeUnsupportedFloatError(f)
+	}
+	if f == 0 {
+		return append(dst, '0'), nil
+	}
+	if f < 0 {
+		dst = append(dst, '-')
+		f = -f
+	}
+	format := byte('e')
+	if 1e-6 <= f && f < 1e21 {
+		format = 'f'
+	}
+	n := len(dst)
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	// ECMAScript writes e-7 and e+21 where Go writes e-07 and e+21
+	if i := strings.IndexByte(string(dst[n:]), 'e'); i >= 0 && dst[n+i+2] == '0' {
+		dst = append(dst[:n+i+2], dst[n+i+3:]...)
+	}
+	return dst, nil
+}
+
+// appendCanonicalString quotes s escaping only quotes, backslashes and
+// control characters, the latter with the short escapes where there are.
+func appendCanonicalString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			dst = append(dst, '\\', c)
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		case '\f':
+			dst = append(dst, '\\', 'f')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		default:
+			if c < 0x20 {
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			} else {
+				dst = append(dst, c)
+			}
+		}
+	}
+	return append(dst, '"')
+}
@@ -0,0 +1,111 @@
+package dynstruct
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+
+	"github.com/json-iterator/go"
+)
+
+// Codec encodes and decodes the Go values of fields for MarshalJSON and
+// UnmarshalJSON, which handle Values, enums, unions and basic types
+// themselves. The codec of a Value applies to the Values nested in it too.
+type Codec interface {
+	// Marshal encodes v, escaping <, > and & in strings if escapeHTML.
+	Marshal(v interface{}, escapeHTML bool) ([]byte, error)
+	// Unmarshal decodes the JSON value data into the pointer v, honoring the
+	// DisallowUnknownFields and UseNumber options.
+	Unmarshal(data []byte, v interface{}, opts DecodeOptions) error
+}
+
+var (
+	// JSONIterCodec is json-iterator behaving like encoding/json, the default.
+	JSONIterCodec = NewJSONIterCodec(jsoniter.Config{SortMapKeys: true, ValidateJsonRawMessage: true})
+	// StdCodec is encoding/json itself.
+	StdCodec Codec = stdCodec{}
+)
+
+var defaultCodec = JSONIterCodec
+
+// SetDefaultCodec sets the codec of the DynStructs defined without one,
+// which must not happen while Values are encoded or decoded.
+func SetDefaultCodec(c Codec) {
+	defaultCodec = c
+}
+
+func codecOf(c Codec) Codec {
+	if c == nil {
+		return defaultCodec
+	}
+	return c
+}
+
+type jsoniterCodec struct {
+	encode [2]jsoniter.API // by escapeHTML
+	decode [4]jsoniter.API // by DisallowUnknownFields and UseNumber
+}
+
+// NewJSONIterCodec makes a Codec of json-iterator configured by config, whose
+// EscapeHTML, DisallowUnknownFields and UseNumber are set as needed. The
+// extensions registered with jsoniter.RegisterExtension apply to it.
+func NewJSONIterCodec(config jsoniter.Config) Codec {
+	c := &jsoniterCodec{}
+	for i := range c.encode {
+		config.EscapeHTML = i == 1
+		c.encode[i] = config.Froze()
+	}
+	config.EscapeHTML = true
+	for i := range c.decode {
+		config.DisallowUnknownFields = i&1 != 0
+		config.UseNumber = i&2 != 0
+		c.decode[i] = config.Froze()
+	}
+	return c
+}
+
+func (c *jsoniterCodec) Marshal(v interface{}, escapeHTML bool) ([]byte, error) {
+	if escapeHTML {
+		return c.encode[1].Marshal(v)
+	}
+	return c.encode[0].Marshal(v)
+}
+
+func (c *jsoniterCodec) Unmarshal(data []byte, v interface{}, opts DecodeOptions) error {
+	i := 0
+	if opts.DisallowUnknownFields {
+		i |= 1
+	}
+	if opts.UseNumber {
+		i |= 2
+	}
+	return c.decode[i].Unmarshal(data, v)
+}
+
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v interface{}, escapeHTML bool) ([]byte, error) {
+	if escapeHTML {
+		return stdjson.Marshal(v)
+	}
+	var buf bytes.Buffer
+	enc := stdjson.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+func (stdCodec) Unmarshal(data []byte, v interface{}, opts DecodeOptions) error {
+	if !opts.DisallowUnknownFields && !opts.UseNumber {
+		return stdjson.Unmarshal(data, v)
+	}
+	dec := stdjson.NewDecoder(bytes.NewReader(data))
+	if opts.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if opts.UseNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
@@ -11,24 +11,83 @@ type definer struct {
 	err    error
 }
 
-func (d *definer) AddField(name string, template interface{}) *definer {
+// FieldOption configures a field added by AddField.
+type FieldOption func(*field)
+
+// Required makes UnmarshalJSON fail if the key of the field is missing.
+func Required() FieldOption {
+	return func(f *field) {
+		f.required = true
+	}
+}
+
+// Aliases makes UnmarshalJSON and NewFromMap accept keys besides the name of
+// the field.
+func Aliases(keys ...string) FieldOption {
+	return func(f *field) {
+		f.aliases = append(f.aliases, keys...)
+	}
+}
+
+// Key sets the key of the field in JSON and the other formats, overriding
+// the naming strategy of the DynStruct.
+func Key(key string) FieldOption {
+	return func(f *field) {
+		f.jsonKey = key
+		f.keyed = true
+	}
+}
+
+func (d *definer) AddField(name string, template interface{}, opts ...FieldOption) *definer {
 	if d.err != nil {
 		return d
 	}
-
-	if !isValidIdent(name) {
-		d.err = makeInvalidNameError("field", name)
+	f, err := fieldOf(name, template)
+	if err != nil {
+		d.err = err
 		return d
 	}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	return d.addField(f)
+}
 
-	if _, ok := d.result.fieldIndex[name]; ok {
-		d.err = makeRepeatedNameError("field", name)
-		return d
+func fieldOf(name string, template interface{}) (field, error) {
+	if !isValidIdent(name) {
+		return field{}, makeInvalidNameError("field", name)
 	}
 
 	if template == nil {
-		d.err = makeNilTypeError(name)
-		return d
+		return field{}, makeNilTypeError(name)
+	}
+
+	if ds, ok := asDynStruct(template); ok {
+		if !ds.finished() {
+			return field{}, makeUnfinishedTypeError(name)
+		}
+		return makeDynField(name, ds), nil
+	}
+
+	if et, ok := template.(enumType); ok {
+		if et.err != nil {
+			return field{}, et.err
+		}
+		return field{name: name, t: stringType, enum: &et}, nil
+	}
+
+	if ut, ok := template.(unionType); ok {
+		if ut.err != nil {
+			return field{}, ut.err
+		}
+		return field{name: name, t: interfaceType, union: &ut}, nil
+	}
+
+	if rt, ok := template.(refType); ok {
+		if rt.err != nil {
+			return field{}, rt.err
+		}
+		return field{name: name, t: rt.t, ds: rt.ds}, nil
 	}
 
 	var t reflect.Type
@@ -38,9 +97,81 @@ func (d *definer) AddField(name string, template interface{}) *definer {
 		t = reflect.TypeOf(template)
 	}
 
-	field := makeField(name, t)
-	d.result.fieldIndex[name] = t
-	d.result.fields = append(d.result.fields, field)
+	return makeField(name, t), nil
+}
+
+func (d *definer) Embed(template interface{}) *definer {
+	if d.err != nil {
+		return d
+	}
+
+	if template == nil {
+		d.err = makeInvalidEmbedError(nil)
+		return d
+	}
+
+	var f field
+	if ds, ok := asDynStruct(template); ok {
+		if !ds.finished() {
+			d.err = makeUnfinishedTypeError("")
+			return d
+		}
+		f = makeDynField(ds.name, ds)
+	} else {
+		t, ok := template.(reflect.Type)
+		if !ok {
+			t = reflect.TypeOf(template)
+		}
+		st := t
+		if st != nil && st.Kind() == reflect.Ptr {
+			st = st.Elem()
+		}
+		if st == nil || st.Kind() != reflect.Struct || st.Name() == "" {
+			d.err = makeInvalidEmbedError(t)
+			return d
+		}
+		f = makeField(st.Name(), t)
+	}
+	f.embedded = true
+	return d.addField(f)
+}
+
+func (d *definer) addField(f field) *definer {
+	if _, ok := d.result.fieldIndex[f.name]; ok {
+		d.err = makeRepeatedNameError("field", f.name)
+		return d
+	}
+	d.result.fieldIndex[f.name] = len(d.result.fields)
+	d.result.fields = append(d.result.fields, f)
+	return d
+}
+
+// WithDecodeOptions sets the options UnmarshalJSON decodes Values with.
+func (d *definer) WithDecodeOptions(opts DecodeOptions) *definer {
+	if d.err != nil {
+		return d
+	}
+	d.result.decodeOpts = opts
+	return d
+}
+
+// WithCodec sets the codec encoding and decoding the Go values of fields,
+// instead of the default one.
+func (d *definer) WithCodec(c Codec) *definer {
+	if d.err != nil {
+		return d
+	}
+	d.result.codec = c
+	return d
+}
+
+// WithNaming sets the strategy deriving the keys of the fields from their
+// names, such as SnakeCase or CamelCase.
+func (d *definer) WithNaming(naming func(name string) string) *definer {
+	if d.err != nil {
+		return d
+	}
+	d.result.naming = naming
 	return d
 }
 
@@ -48,27 +179,112 @@ func (d *definer) Finish() (DynStruct, error) {
 	if d.err != nil {
 		return d.result, d.err
 	}
+	d.result.resolvePromoted()
+	if err := d.result.resolveKeys(); err != nil {
+		d.err = err
+		return d.result, err
+	}
+	d.result.decodeOpts.codec = d.result.codec
+	d.result.compileEncoders()
 	d.result.zeroValue = d.result.newWithoutInit()
 	for _, field := range d.result.fields {
-		d.result.zeroValue.value[field.name] = reflect.New(field.t).Elem().Interface()
+		d.result.zeroValue.value[field.name] = field.zero()
 	}
 	d.err = makeRecallError("definer.Finish()")
 	return d.result, nil
 }
 
+// Ref returns the DynStruct being defined, which can be referred to through
+// PtrTo, SliceOf and MapOf before Finish to define recursive types.
+func (d *definer) Ref() *DynStruct {
+	return &d.result
+}
+
+type refType struct {
+	t   reflect.Type
+	ds  *DynStruct
+	err error
+}
+
+func PtrTo(elem interface{}) refType {
+	rt := makeRefType(elem)
+	if rt.err == nil {
+		rt.t = reflect.PtrTo(rt.t)
+	}
+	return rt
+}
+
+func SliceOf(elem interface{}) refType {
+	rt := makeRefType(elem)
+	if rt.err == nil {
+		rt.t = reflect.SliceOf(rt.t)
+	}
+	return rt
+}
+
+func MapOf(key reflect.Type, elem interface{}) refType {
+	rt := makeRefType(elem)
+	if rt.err == nil {
+		if key == nil || key.Kind() != reflect.String {
+			return refType{err: makeInvalidMapKeyError(key)}
+		}
+		rt.t = reflect.MapOf(key, rt.t)
+	}
+	return rt
+}
+
+func makeRefType(elem interface{}) refType {
+	if elem == nil {
+		return refType{err: makeNilTypeError("")}
+	}
+	if ds, ok := asDynStruct(elem); ok {
+		if ds == nil {
+			return refType{err: makeUnfinishedTypeError("")}
+		}
+		return refType{t: valueType, ds: ds}
+	}
+	if rt, ok := elem.(refType); ok {
+		return rt
+	}
+	if t, ok := elem.(reflect.Type); ok {
+		return refType{t: t}
+	}
+	return refType{t: reflect.TypeOf(elem)}
+}
+
+// asDynStruct reports whether template is a DynStruct, returning the instance
+// its Values refer to.
+func asDynStruct(template interface{}) (*DynStruct, bool) {
+	switch ds := template.(type) {
+	case DynStruct:
+		return ds.self, true
+	case *DynStruct:
+		if ds == nil {
+			return nil, true
+		}
+		return ds.self, true
+	}
+	return nil, false
+}
+
 func Define(name string) *definer {
+	return define(getPkgName(), name)
+}
+
+func define(pkg, name string) *definer {
 	if !isValidIdent(name) {
 		return &definer{err: makeInvalidNameError("type", name)}
 	}
-	pkg := getPkgName()
-	return &definer{
+	d := &definer{
 		result: DynStruct{
 			pkg:        pkg,
 			name:       name,
 			fullName:   pkg + "." + name,
-			fieldIndex: make(map[string]reflect.Type),
+			fieldIndex: make(map[string]int),
 		},
 	}
+	d.result.self = &d.result
+	return d
 }
 
 func getPkgName() string {
@@ -2,18 +2,28 @@ package dynstruct
 
 import (
 	"bytes"
+	stdjson "encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/nextzhou/dynstruct/internal/jsonscan"
 
 	"github.com/json-iterator/go"
 	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v3"
 )
 
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
 var data = []byte(`{"Field1":"abcdefg","Field2":1234,"Field3":1234.5678}`)
 
 func TestDefine(t *testing.T) {
@@ -208,6 +218,18 @@ func TestNewValue(t *testing.T) {
 		val2 := typ.New()
 		So(val2.Get("int"), ShouldBeZeroValue)
 	})
+
+	Convey("values from maps are of the defined type", t, func() {
+		inner, _ := Define("Inner").AddField("I", reflect.TypeOf(0)).Finish()
+		outer, _ := Define("Outer").AddField("I", inner).Finish()
+		val := inner.NewFromMapUnsafely(map[string]interface{}{"I": 1})
+		outerVal := outer.New()
+		So(func() { outerVal.Set("I", val) }, ShouldNotPanic)
+		So(func() { inner.NewSlice().Append(val) }, ShouldNotPanic)
+		val, err := inner.NewFromMap(map[string]interface{}{"I": 2})
+		So(err, ShouldBeNil)
+		So(func() { outerVal.Set("I", val) }, ShouldNotPanic)
+	})
 }
 
 func TestSetValue(t *testing.T) {
@@ -395,6 +417,50 @@ func TestJsonMarshal(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(string(data), ShouldEqual, `{"int":123,"pint":456,"str":"789"}`)
 	})
+
+	Convey("JSON marshal unchecked values", t, func() {
+		typ, err := Define("Scalars").
+			AddField("I", reflect.TypeOf(0)).
+			AddField("U", reflect.TypeOf(uint(0))).
+			AddField("F", reflect.TypeOf(0.0)).
+			AddField("F32", reflect.TypeOf(float32(0))).
+			AddField("B", reflect.TypeOf(false)).
+			AddField("S", reflect.TypeOf("")).
+			AddField("T", reflect.TypeOf(time.Time{})).
+			Finish()
+		So(err, ShouldBeNil)
+
+		val := typ.NewFromMapUnsafely(map[string]interface{}{"S": "x"})
+		data, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"I":null,"U":null,"F":null,"F32":null,"B":null,"S":"x","T":null}`)
+
+		val = typ.New()
+		val.UncheckSet("I", "1")
+		val.UncheckSet("U", -1)
+		val.UncheckSet("F", 1)
+		val.UncheckSet("F32", "f")
+		val.UncheckSet("B", 0)
+		val.UncheckSet("S", 2)
+		val.UncheckSet("T", "now")
+		data, err = val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"I":"1","U":-1,"F":1,"F32":"f","B":0,"S":2,"T":"now"}`)
+
+		inner, _ := Define("Inner").AddField("I", reflect.TypeOf(0)).Finish()
+		outer, err := Define("Outer").AddField("In", inner).AddField("P", PtrTo(inner)).Finish()
+		So(err, ShouldBeNil)
+		val = outer.New()
+		val.UncheckSet("In", nil)
+		val.UncheckSet("P", nil)
+		data, err = val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"In":null,"P":null}`)
+		val.UncheckSet("In", Value{})
+		data, err = val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"In":null,"P":null}`)
+	})
 }
 
 func TestJsonUnmarshal(t *testing.T) {
@@ -431,114 +497,1786 @@ func TestJsonUnmarshal(t *testing.T) {
 		So(val.Get("pint").(*int), ShouldBeNil)
 		So(val.Get("str").(string), ShouldEqual, "")
 
+		data = []byte(`{"str":"abc","int":456}`)
+		err = json.Unmarshal(data, &val)
+		So(err, ShouldBeNil)
+		So(val.Get("int").(int), ShouldEqual, 456)
+
+		kvs, err := jsonscan.Scan([]byte(`{"a":"x","b":12}`))
+		So(err, ShouldBeNil)
+		So(kvs, ShouldHaveLength, 2)
+		So(string(kvs[1].Value), ShouldEqual, "12")
+		data = []byte(`{"int":5}`)
+		So(val.UnmarshalJSON(data), ShouldBeNil)
+		So(val.Get("int"), ShouldEqual, 5)
+
 		data = []byte(`{"int":"abc"}`)
 		err = json.Unmarshal(data, &val)
 		So(err, ShouldNotBeNil)
 	})
 }
 
-func BenchmarkMarshalJsonStruct(b *testing.B) {
-	b.ReportAllocs()
-	val := struct {
-		Field1 string
-		Field2 int
-		Field3 float64
-	}{
-		"abcdefg",
-		1234,
-		1234.5678,
-	}
-	for i := 0; i < b.N; i++ {
-		json.Marshal(val)
+func TestEmbed(t *testing.T) {
+	type Meta struct {
+		ID   int
+		Note string `json:"note"`
 	}
+	Convey("embed", t, func() {
+		base, err := Define("Base").
+			AddField("Name", reflect.TypeOf("")).
+			AddField("ID", reflect.TypeOf(int(0))).
+			Finish()
+		So(err, ShouldBeNil)
+
+		Convey("invalid embedded type", func() {
+			_, err := Define("Abc").Embed(0).Finish()
+			So(err, ShouldBeError, "invalid embedded type: int")
+
+			_, err = Define("Abc").Embed(struct{ A int }{}).Finish()
+			So(err, ShouldBeError, "invalid embedded type: struct { A int }")
+
+			_, err = Define("Abc").Embed(base).AddField("Base", "").Finish()
+			So(err, ShouldBeError, `repeated field name: "Base"`)
+		})
+
+		typ, err := Define("Abc").
+			Embed(base).
+			Embed(Meta{}).
+			AddField("Name", reflect.TypeOf("")).
+			AddField("Age", reflect.TypeOf(int(0))).
+			Finish()
+		So(err, ShouldBeNil)
+		val := typ.New()
+
+		Convey("promoted fields", func() {
+			val.Set("Name", "outer")
+			val.Set("Note", "note")
+			val.Set("Age", 18)
+			So(val.Get("Name"), ShouldEqual, "outer")
+			So(val.Get("Note"), ShouldEqual, "note")
+			So(val.Get("Meta"), ShouldResemble, Meta{Note: "note"})
+			So(val.Get("Base").(Value).Get("Name"), ShouldEqual, "")
+
+			// ID is ambiguous between Base and Meta
+			So(func() { val.Get("ID") }, ShouldPanic)
+			So(func() { val.Set("Note", 1) }, ShouldPanic)
+			So(func() { val.Set("Base", typ.New()) }, ShouldPanic)
+
+			copied := val.Copy()
+			copied.Get("Base").(Value).Set("Name", "base")
+			So(val.Get("Base").(Value).Get("Name"), ShouldEqual, "")
+		})
+
+		Convey("json", func() {
+			val.Get("Base").(Value).Set("Name", "base")
+			val.Get("Base").(Value).Set("ID", 1)
+			val.Set("Meta", Meta{ID: 2, Note: "note"})
+			val.Set("Name", "outer")
+			val.Set("Age", 18)
+
+			data, err := json.Marshal(val)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"note":"note","Name":"outer","Age":18}`)
+
+			val2 := typ.New()
+			err = json.Unmarshal([]byte(`{"Name":"outer","note":"abc","ID":3}`), &val2)
+			So(err, ShouldBeNil)
+			So(val2.Get("Name"), ShouldEqual, "outer")
+			So(val2.Get("Note"), ShouldEqual, "abc")
+			So(val2.Get("Base").(Value).Get("Name"), ShouldEqual, "")
+			So(val2.Get("Base").(Value).Get("ID"), ShouldEqual, 0)
+			So(val2.Get("Meta").(Meta).ID, ShouldEqual, 0)
+		})
+
+		Convey("format", func() {
+			val.Get("Base").(Value).Set("Name", "base")
+			val.Set("Note", "note")
+			val.Set("Name", "outer")
+			So(fmt.Sprint(val), ShouldEqual, "{{base 0} {0 note} outer 0}")
+			So(fmt.Sprintf("%+v", val), ShouldEqual, "{Base:{Name:base ID:0} Meta:{ID:0 Note:note} Name:outer Age:0}")
+			So(fmt.Sprintf("%#v", val), ShouldEqual,
+				`dynstruct.Abc{Base:dynstruct.Base{Name:"base", ID:0}, Meta:dynstruct.Meta{ID:0, Note:"note"}, Name:"outer", Age:0}`)
+		})
+	})
 }
 
-func BenchmarkMarshalJsonDynStruct(b *testing.B) {
-	b.ReportAllocs()
-	typ, _ := Define("T").
-		AddField("Field1", reflect.TypeOf("")).
-		AddField("Field2", reflect.TypeOf(int(0))).
-		AddField("Field3", reflect.TypeOf(float64(0))).Finish()
-	val := typ.New()
-	val.Set("Field1", "abcdefg")
-	val.Set("Field2", int(1234))
-	val.Set("Field3", float64(1234.5678))
-	for i := 0; i < b.N; i++ {
-		json.Marshal(val)
-	}
+func TestRecursive(t *testing.T) {
+	Convey("recursive", t, func() {
+		Convey("invalid reference", func() {
+			d := Define("Node")
+			_, err := d.AddField("Self", d.Ref()).Finish()
+			So(err, ShouldBeError, `type of field "Self" is not finished`)
+
+			d = Define("Node")
+			_, err = d.Embed(d.Ref()).Finish()
+			So(err, ShouldBeError, "embedded type is not finished")
+
+			d = Define("Node")
+			_, err = d.AddField("Children", MapOf(reflect.TypeOf(0), d.Ref())).Finish()
+			So(err, ShouldBeError, "invalid map key type: int")
+		})
+
+		d := Define("Node")
+		typ, err := d.
+			AddField("Name", reflect.TypeOf("")).
+			AddField("Parent", PtrTo(d.Ref())).
+			AddField("Children", SliceOf(d.Ref())).
+			AddField("Index", MapOf(reflect.TypeOf(""), PtrTo(d.Ref()))).
+			Finish()
+		So(err, ShouldBeNil)
+
+		root := typ.New()
+		root.Set("Name", "root")
+		child := typ.New()
+		child.Set("Name", "child")
+		child.Set("Parent", &root)
+		So(func() { child.Set("Children", []Value{root, {}}) }, ShouldPanic)
+
+		Convey("json", func() {
+			child.Set("Parent", nil)
+			root.Set("Children", []Value{child})
+			root.Set("Index", map[string]*Value{"child": &child})
+			data, err := json.Marshal(root)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual,
+				`{"Name":"root","Parent":null,"Children":[{"Name":"child","Parent":null,"Children":null,"Index":null}],`+
+					`"Index":{"child":{"Name":"child","Parent":null,"Children":null,"Index":null}}}`)
+
+			val := typ.New()
+			err = json.Unmarshal(data, &val)
+			So(err, ShouldBeNil)
+			So(val.Get("Children").([]Value)[0].Get("Name"), ShouldEqual, "child")
+			So(val.Get("Index").(map[string]*Value)["child"].Get("Name"), ShouldEqual, "child")
+
+			child.Set("Parent", &root)
+			_, err = json.Marshal(root)
+			So(err, ShouldNotBeNil)
+			data, err = root.MarshalJSON()
+			So(err, ShouldBeError, `encountered a cycle via value of type "dynstruct.Node"`)
+			So(data, ShouldBeNil)
+		})
+
+		Convey("copy", func() {
+			root.Set("Children", []Value{child})
+			copied := child.DeepCopy()
+			parent := copied.Get("Parent").(*Value)
+			So(parent, ShouldNotPointTo, &root)
+			So(parent.Get("Name"), ShouldEqual, "root")
+			So(parent.Get("Children").([]Value)[0].Get("Parent"), ShouldPointTo, parent)
+		})
+
+		Convey("format", func() {
+			root.Set("Children", []Value{child})
+			child.Set("Parent", nil)
+			So(fmt.Sprint(root), ShouldEqual, "{root <nil> [{child <nil> [] map[]}] map[]}")
+			So(fmt.Sprintf("%#v", child), ShouldEqual,
+				`dynstruct.Node{Name:"child", Parent:(*dynstruct.Node)(nil), Children:[]dynstruct.Node(nil), Index:map[string]*dynstruct.Node(nil)}`)
+
+			child.Set("Children", []Value{root})
+			So(fmt.Sprint(root), ShouldEqual, "{root <nil> [{child <nil> [<cycle>] map[]}] map[]}")
+		})
+	})
 }
 
-func BenchmarkMarshalJsonMap(b *testing.B) {
-	b.ReportAllocs()
-	val := map[string]interface{}{
-		"Field1": "abcdefg",
-		"Field2": int(1234),
-		"Field3": float64(1234.5678),
-	}
-	for i := 0; i < b.N; i++ {
-		json.Marshal(val)
+func TestUnion(t *testing.T) {
+	type Point struct {
+		X, Y int
 	}
+	Convey("union", t, func() {
+		circle, err := Define("Circle").AddField("Radius", reflect.TypeOf(float64(0))).Finish()
+		So(err, ShouldBeNil)
+		rect, err := Define("Rect").
+			AddField("Width", reflect.TypeOf(float64(0))).
+			AddField("Height", reflect.TypeOf(float64(0))).
+			Finish()
+		So(err, ShouldBeNil)
+
+		Convey("invalid union", func() {
+			_, err := Define("Abc").AddField("Any", Union()).Finish()
+			So(err, ShouldBeError, `invalid union variant: ""`)
+
+			_, err = Define("Abc").AddField("Any", Union(0, 1)).Finish()
+			So(err, ShouldBeError, `repeated variant name: "int"`)
+
+			_, err = Define("Abc").AddField("Any", Union(circle, 0).Tagged("kind")).Finish()
+			So(err, ShouldBeError, `invalid union variant: "int"`)
+		})
+
+		Convey("shape detection", func() {
+			typ, err := Define("Abc").
+				AddField("Any", Union(float64(0), 0, "", circle, rect, Point{})).
+				Finish()
+			So(err, ShouldBeNil)
+			val := typ.New()
+			So(val.Variant("Any"), ShouldEqual, "")
+			So(func() { val.Set("Any", int8(1)) }, ShouldPanic)
+			So(func() { val.Variant("Abc") }, ShouldPanic)
+
+			val.Set("Any", Point{X: 1, Y: 2})
+			So(val.Variant("Any"), ShouldEqual, "Point")
+			data, err := json.Marshal(val)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"Any":{"X":1,"Y":2}}`)
+
+			cases := []struct {
+				data    string
+				variant string
+			}{
+				{`{"Any":1}`, "int"},
+				{`{"Any":1.5}`, "float64"},
+				{`{"Any":"abc"}`, "string"},
+				{`{"Any":{"Radius":1}}`, "Circle"},
+				{`{"Any":{"Width":1,"Height":2}}`, "Rect"},
+				{`{"Any":{"X":1}}`, "Point"},
+				{`{"Any":null}`, ""},
+			}
+			for _, c := range cases {
+				err = json.Unmarshal([]byte(c.data), &val)
+				So(err, ShouldBeNil)
+				So(val.Variant("Any"), ShouldEqual, c.variant)
+			}
+			So(val.Get("Any"), ShouldBeNil)
+
+			err = val.UnmarshalJSON([]byte(`{"Any":[1]}`))
+			So(err, ShouldBeError, `union field "Any" has no variant matching "array"`)
+		})
+
+		Convey("tagged", func() {
+			typ, err := Define("Abc").
+				AddField("Shape", Union(circle, rect).Tagged("kind")).
+				Finish()
+			So(err, ShouldBeNil)
+			val := typ.New()
+
+			c := circle.New()
+			c.Set("Radius", 1.5)
+			val.Set("Shape", c)
+			So(val.Variant("Shape"), ShouldEqual, "Circle")
+			data, err := json.Marshal(val)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"Shape":{"kind":"Circle","Radius":1.5}}`)
+
+			err = json.Unmarshal([]byte(`{"Shape":{"Radius":3,"kind":"Rect"}}`), &val)
+			So(err, ShouldBeNil)
+			So(val.Variant("Shape"), ShouldEqual, "Rect")
+
+			err = val.UnmarshalJSON([]byte(`{"Shape":{"kind":"Square"}}`))
+			So(err, ShouldBeError, `union field "Shape" has no variant matching "Square"`)
+
+			type Inner struct{ V int }
+			typ, err = Define("Abc").AddField("X", Union((*Inner)(nil)).Tagged("kind")).Finish()
+			So(err, ShouldBeNil)
+			val = typ.New()
+			val.Set("X", (*Inner)(nil))
+			data, err = json.Marshal(val)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"X":null}`)
+			val.Set("X", &Inner{V: 1})
+			data, err = json.Marshal(val)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"X":{"kind":"*dynstruct.Inner","V":1}}`)
+			opts := DecodeOptions{DisallowUnknownFields: true}
+			So(val.UnmarshalJSONOptions([]byte(`{"X":{"kind":"*dynstruct.Inner","V":2}}`), opts), ShouldBeNil)
+			So(val.Get("X"), ShouldResemble, &Inner{V: 2})
+		})
+
+		Convey("tagged disallowing unknown fields", func() {
+			typ, err := Define("Abc").
+				AddField("Shape", Union(circle, rect).Tagged("kind")).
+				Finish()
+			So(err, ShouldBeNil)
+			val := typ.New()
+			opts := DecodeOptions{DisallowUnknownFields: true}
+			So(val.UnmarshalJSONOptions([]byte(`{"Shape":{"kind":"Circle","Radius":2}}`), opts), ShouldBeNil)
+			So(val.Variant("Shape"), ShouldEqual, "Circle")
+			So(val.Get("Shape").(Value).Get("Radius"), ShouldEqual, 2)
+			So(val.UnmarshalJSONOptions([]byte(`{"Shape":{"kind":"Circle","Radius":2,"Other":1}}`), opts),
+				ShouldBeError, `type "dynstruct.Circle" has no field for key "Other"`)
+		})
+
+		Convey("tagged keeping unknown fields", func() {
+			typ, err := Define("Abc").
+				AddField("Shape", Union(circle, rect).Tagged("kind")).
+				Finish()
+			So(err, ShouldBeNil)
+			val := typ.New()
+			opts := DecodeOptions{KeepUnknownFields: true}
+			So(val.UnmarshalJSONOptions([]byte(`{"Shape":{"kind":"Circle","Radius":2,"Other":1}}`), opts), ShouldBeNil)
+			So(val.Get("Shape").(Value).UnknownFields(), ShouldResemble, []RawField{{Key: "Other", Value: []byte("1")}})
+			data, err := val.MarshalJSON()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"Shape":{"kind":"Circle","Radius":2,"Other":1}}`)
+		})
+	})
 }
 
-func BenchmarkUnmarshalJsonStruct(b *testing.B) {
-	b.ReportAllocs()
-	var val struct {
-		Field1 string
-		Field2 int
-		Field3 float64
-	}
-	for i := 0; i < b.N; i++ {
-		err := json.Unmarshal(data, &val)
-		if err != nil {
-			panic(err)
-		}
-	}
+func TestEnum(t *testing.T) {
+	Convey("enum", t, func() {
+		Convey("invalid enum", func() {
+			_, err := Define("Abc").AddField("Status", Enum()).Finish()
+			So(err, ShouldBeError, `invalid enum member name: ""`)
+
+			_, err = Define("Abc").AddField("Status", Enum("on", "off", "on")).Finish()
+			So(err, ShouldBeError, `repeated enum member name: "on"`)
+
+			_, err = Define("Abc").AddField("Status", Enum("on", "off").WithCodes(1)).Finish()
+			So(err, ShouldBeError, "enum of 2 members given 1 codes")
+
+			_, err = Define("Abc").AddField("Status", Enum("on", "off").WithCodes(1, 1)).Finish()
+			So(err, ShouldBeError, "repeated enum code: 1")
+		})
+
+		status := Enum("active", "inactive", "deleted").WithCodes(1, 2, 4)
+		typ, err := Define("Abc").
+			AddField("Status", status).
+			AddField("Code", status.EncodeCodes()).
+			Finish()
+		So(err, ShouldBeNil)
+		val := typ.New()
+		So(val.Get("Status"), ShouldEqual, "active")
+
+		So(func() { val.Set("Status", "unknown") }, ShouldPanic)
+		So(func() { val.Set("Status", 3) }, ShouldPanic)
+		So(func() { val.Set("Status", 1.0) }, ShouldPanic)
+		val.Set("Status", "deleted")
+		val.Set("Code", uint8(2))
+		So(val.Get("Code"), ShouldEqual, "inactive")
+
+		data, err := json.Marshal(val)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"Status":"deleted","Code":2}`)
+		So(fmt.Sprintf("%+v", val), ShouldEqual, "{Status:deleted Code:inactive}")
+
+		err = val.UnmarshalJSON([]byte(`{"Status":4,"Code":"active"}`))
+		So(err, ShouldBeNil)
+		So(val.Get("Status"), ShouldEqual, "deleted")
+		So(val.Get("Code"), ShouldEqual, "active")
+
+		err = val.UnmarshalJSON([]byte(`{"Status":"unknown"}`))
+		So(err, ShouldBeError, `enum field "Status" has no member "unknown"`)
+		err = val.UnmarshalJSON([]byte(`{"Status":3}`))
+		So(err, ShouldBeError, `enum field "Status" has no member "3"`)
+	})
 }
-func BenchmarkUnmarshalJsonDynStruct(b *testing.B) {
-	b.ReportAllocs()
-	typ, _ := Define("T").
-		AddField("Field1", reflect.TypeOf("")).
-		AddField("Field2", reflect.TypeOf(int(0))).
-		AddField("Field3", reflect.TypeOf(float64(0))).
-		Finish()
-	for i := 0; i < b.N; i++ {
+
+func TestInfer(t *testing.T) {
+	Convey("infer", t, func() {
+		Convey("invalid sample", func() {
+			_, err := Infer("Abc").Add([]byte(`[1]`)).Finish()
+			So(err, ShouldBeError, "sample must be a JSON object, got array")
+
+			_, err = Infer("Abc").Finish()
+			So(err, ShouldBeError, "sample must be a JSON object, got nothing")
+
+			_, err = Infer("Abc").Add([]byte(`{"a":}`)).Finish()
+			So(err, ShouldNotBeNil)
+		})
+
+		in := Infer("Order").AddNDJSON(bytes.NewBufferString(`
+			{"id":1,"price":10,"tags":["a"],"customer":{"name":"x"},"note":"abc","items":[{"sku":"a","qty":1}]}
+			{"id":2,"price":10.5,"tags":[],"customer":{"name":"y","vip":true},"note":1,"items":[{"sku":"b","qty":null}],"user-id":3}
+			{"id":3,"price":11,"customer":null,"note":"def","extra":null}
+		`))
+		typ, err := in.Finish()
+		So(err, ShouldBeNil)
+		So(in.Conflicts(), ShouldResemble, []Conflict{
+			{Path: "note", Types: []string{"string", "int"}},
+		})
+
 		val := typ.New()
-		err := json.Unmarshal(data, &val)
-		if err != nil {
-			panic(err)
+		So(fmt.Sprintf("%#v", val), ShouldEqual, `dynstruct.Order{id:0, price:0, tags:[]string(nil), `+
+			`customer:(*dynstruct.Customer)(nil), note:<nil>, items:[]dynstruct.Items(nil), userId:(*int)(nil), extra:<nil>}`)
+
+		err = val.UnmarshalJSON([]byte(`{"id":4,"customer":{"name":"z"},"items":[{"sku":"c","qty":2}],"user-id":5}`))
+		So(err, ShouldBeNil)
+		So(*val.Get("userId").(*int), ShouldEqual, 5)
+
+		Convey("keys that are not identifiers", func() {
+			typ, err := Infer("Keys").Add([]byte(`{"user-id":1,"userId":2,"2fa":{"on-off":true},"-":3}`)).Finish()
+			So(err, ShouldBeNil)
+			So(fmt.Sprintf("%#v", typ.New()), ShouldEqual, `dynstruct.Keys{userId2:0, userId:0, _2fa:dynstruct._2fa{onOff:false}, _:0}`)
+			val := typ.New()
+			So(val.UnmarshalJSON([]byte(`{"user-id":1,"userId":2,"2fa":{"on-off":true},"-":3}`)), ShouldBeNil)
+			data, err := val.MarshalJSON()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"user-id":1,"userId":2,"2fa":{"on-off":true},"-":3}`)
+		})
+		So(val.Get("customer").(*Value).Get("name"), ShouldEqual, "z")
+		So(val.Get("customer").(*Value).Get("vip"), ShouldBeNil)
+		So(*val.Get("items").([]Value)[0].Get("qty").(*int), ShouldEqual, 2)
+	})
+}
+
+type testAge int
+
+type testID int
+
+func (id testID) MarshalText() ([]byte, error) {
+	return []byte("id-" + strconv.Itoa(int(id))), nil
+}
+
+func (id *testID) UnmarshalText(text []byte) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(string(text), "id-"))
+	*id = testID(n)
+	return err
+}
+
+type testStatus string
+
+func (s testStatus) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(len(s))), nil
+}
+
+func (s *testStatus) UnmarshalJSON(data []byte) error {
+	n, err := strconv.Atoi(string(data))
+	*s = testStatus(strings.Repeat("*", n))
+	return err
+}
+
+func TestAppendJSON(t *testing.T) {
+	Convey("append JSON", t, func() {
+		typ, err := Define("Abc").
+			AddField("Bool", reflect.TypeOf(false)).
+			AddField("Int8", reflect.TypeOf(int8(0))).
+			AddField("Uint", reflect.TypeOf(uint(0))).
+			AddField("Age", reflect.TypeOf(testAge(0))).
+			AddField("ID", reflect.TypeOf(testID(0))).
+			AddField("Float32", reflect.TypeOf(float32(0))).
+			AddField("Float64", reflect.TypeOf(float64(0))).
+			AddField("Str", reflect.TypeOf("")).
+			AddField("Time", reflect.TypeOf(time.Time{})).
+			Finish()
+		So(err, ShouldBeNil)
+		val := typ.New()
+
+		floats := []float64{0, 1, -1.5, 1e-7, 1e21, 123456789.123, 3.4e38}
+		strs := []string{"", "abc", `"\/`, "<a&b>", "\n\t\x01", "中文\u2028", "\u00e9"}
+		for i := range floats {
+			val.Set("Bool", i%2 == 0)
+			val.Set("Int8", int8(-i))
+			val.Set("Uint", uint(i))
+			val.Set("Age", testAge(i))
+			val.Set("ID", testID(i))
+			val.Set("Float32", float32(floats[i]))
+			val.Set("Float64", floats[i])
+			val.Set("Str", strs[i])
+			val.Set("Time", time.Date(2000+i, 1, 2, 3, 4, 5, i*1000, time.FixedZone("", i*3600)))
+
+			expected := bytes.NewBufferString("{")
+			for j, field := range typ.fields {
+				if j > 0 {
+					expected.WriteByte(',')
+				}
+				d, err := stdjson.Marshal(val.Get(field.name))
+				So(err, ShouldBeNil)
+				fmt.Fprintf(expected, `"%s":%s`, field.name, d)
+			}
+			expected.WriteByte('}')
+
+			data, err := val.AppendJSON([]byte("prefix"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "prefix"+expected.String())
 		}
-	}
+
+		val.Set("Str", "a\xffb")
+		data, err := val.AppendJSON(nil)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldContainSubstring, `"Str":"a\ufffdb"`)
+
+		val.Set("Float64", math.NaN())
+		_, err = val.AppendJSON(nil)
+		So(err, ShouldBeError, "unsupported float value: NaN")
+	})
+
+	Convey("append JSON without allocation", t, func() {
+		typ, err := Define("Abc").
+			AddField("Int", reflect.TypeOf(int(0))).
+			AddField("Float", reflect.TypeOf(float64(0))).
+			AddField("Str", reflect.TypeOf("")).
+			AddField("Time", reflect.TypeOf(time.Time{})).
+			Finish()
+		So(err, ShouldBeNil)
+		val := typ.New()
+		val.Set("Int", 123)
+		val.Set("Float", 1.5)
+		val.Set("Str", "abc")
+		val.Set("Time", time.Now())
+
+		buf := make([]byte, 0, 1024)
+		allocs := testing.AllocsPerRun(100, func() {
+			buf, _ = val.AppendJSON(buf[:0])
+		})
+		So(allocs, ShouldEqual, 0)
+	})
 }
 
-func BenchmarkUnmarshalJsonDynStructExplicit(b *testing.B) {
-	b.ReportAllocs()
-	typ, _ := Define("T").
-		AddField("Field1", reflect.TypeOf("")).
-		AddField("Field2", reflect.TypeOf(int(0))).
-		AddField("Field3", reflect.TypeOf(float64(0))).
+func TestEncoder(t *testing.T) {
+	inner, _ := Define("Inner").AddField("Html", reflect.TypeOf("")).Finish()
+	typ, err := Define("Abc").
+		AddField("FieldA", reflect.TypeOf(int(0))).
+		AddField("Inner", inner).
 		Finish()
-	for i := 0; i < b.N; i++ {
+	if err != nil {
+		panic(err)
+	}
+	newVal := func(i int) Value {
 		val := typ.New()
-		err := val.UnmarshalJSON(data)
-		if err != nil {
-			panic(err)
-		}
+		val.Set("FieldA", i)
+		in := inner.New()
+		in.Set("Html", "<b>")
+		val.Set("Inner", in)
+		return val
 	}
+
+	Convey("encode NDJSON", t, func() {
+		buf := bytes.NewBuffer(nil)
+		enc := NewEncoder(buf)
+		So(enc.Encode(newVal(1)), ShouldBeNil)
+		So(enc.Encode(newVal(2)), ShouldBeNil)
+		So(buf.String(), ShouldEqual, `{"FieldA":1,"Inner":{"Html":"\u003cb\u003e"}}
+{"FieldA":2,"Inner":{"Html":"\u003cb\u003e"}}
+`)
+	})
+
+	Convey("encode with options", t, func() {
+		buf := bytes.NewBuffer(nil)
+		enc := NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.SetKeyNaming(strings.ToLower)
+		enc.SetIndent(">", "  ")
+		So(enc.Encode(newVal(1)), ShouldBeNil)
+		So(buf.String(), ShouldEqual, `{
+>  "fielda": 1,
+>  "inner": {
+>    "html": "<b>"
+>  }
+>}
+`)
+	})
+
+	Convey("encode with key naming and explicit keys", t, func() {
+		base, err := Define("Base").AddField("FieldC", reflect.TypeOf(0), Key("c")).Finish()
+		So(err, ShouldBeNil)
+		typ, err := Define("Keyed").
+			AddField("FieldA", reflect.TypeOf(0), Key("a")).
+			AddField("FieldB", reflect.TypeOf(0)).
+			Embed(base).
+			Finish()
+		So(err, ShouldBeNil)
+		buf := bytes.NewBuffer(nil)
+		enc := NewEncoder(buf)
+		enc.SetKeyNaming(strings.ToUpper)
+		So(enc.Encode(typ.New()), ShouldBeNil)
+		So(buf.String(), ShouldEqual, "{\"a\":0,\"FIELDB\":0,\"c\":0}\n")
+	})
+
+	Convey("encode array", t, func() {
+		buf := bytes.NewBuffer(nil)
+		enc := NewEncoder(buf)
+		So(enc.EndArray(), ShouldBeError, "Encoder.EndArray() called without Encoder.BeginArray()")
+		So(enc.BeginArray(), ShouldBeNil)
+		So(enc.EndArray(), ShouldBeNil)
+		So(enc.BeginArray(), ShouldBeNil)
+		for i := 0; i < 3; i++ {
+			So(enc.Encode(newVal(i)), ShouldBeNil)
+		}
+		So(enc.EndArray(), ShouldBeNil)
+		var decoded []map[string]interface{}
+		dec := stdjson.NewDecoder(buf)
+		So(dec.Decode(&decoded), ShouldBeNil)
+		So(decoded, ShouldBeEmpty)
+		So(dec.Decode(&decoded), ShouldBeNil)
+		So(decoded, ShouldHaveLength, 3)
+		So(decoded[2]["FieldA"], ShouldEqual, 2)
+
+		buf.Reset()
+		enc.SetIndent("", "\t")
+		So(enc.BeginArray(), ShouldBeNil)
+		So(enc.Encode(newVal(1)), ShouldBeNil)
+		So(enc.Encode(newVal(2)), ShouldBeNil)
+		So(enc.EndArray(), ShouldBeNil)
+		So(buf.String(), ShouldEqual, "[\n\t{\n\t\t\"FieldA\": 1,\n\t\t\"Inner\": {\n\t\t\t\"Html\": \"\\u003cb\\u003e\"\n\t\t}\n\t},"+
+			"\n\t{\n\t\t\"FieldA\": 2,\n\t\t\"Inner\": {\n\t\t\t\"Html\": \"\\u003cb\\u003e\"\n\t\t}\n\t}\n]\n")
+	})
 }
 
-func BenchmarkUnmarshalJsonMap(b *testing.B) {
-	b.ReportAllocs()
-	for i := 0; i < b.N; i++ {
-		var val map[string]interface{}
-		err := json.Unmarshal(data, &val)
-		if err != nil {
-			panic(err)
+func TestDecoder(t *testing.T) {
+	typ, err := Define("Abc").
+		AddField("FieldA", reflect.TypeOf(int(0))).
+		AddField("FieldB", reflect.TypeOf("")).
+		Finish()
+	if err != nil {
+		panic(err)
+	}
+	decodeAll := func(input string) ([]Value, error) {
+		dec := typ.NewDecoder(strings.NewReader(input))
+		var vals []Value
+		for dec.More() {
+			var val Value
+			if err := dec.Decode(&val); err != nil {
+				return vals, err
+			}
+			vals = append(vals, val)
 		}
+		var val Value
+		So(dec.Decode(&val), ShouldEqual, io.EOF)
+		return vals, nil
 	}
-}
 
-func BenchmarkUnmarshalJsonRawMessageMap(b *testing.B) {
-	b.ReportAllocs()
+	Convey("decode NDJSON", t, func() {
+		vals, err := decodeAll("{\"FieldA\":1,\"FieldB\":\"a\"}\n{\"FieldA\":2}\n\n")
+		So(err, ShouldBeNil)
+		So(vals, ShouldHaveLength, 2)
+		So(vals[0].Get("FieldB"), ShouldEqual, "a")
+		So(vals[1].Get("FieldA"), ShouldEqual, 2)
+		So(vals[1].Get("FieldB"), ShouldEqual, "")
+
+		vals, err = decodeAll(" \n")
+		So(err, ShouldBeNil)
+		So(vals, ShouldBeEmpty)
+	})
+
+	Convey("decode array", t, func() {
+		vals, err := decodeAll(` [ {"FieldA":1}, {"FieldA":2,"FieldB":"b"} ] `)
+		So(err, ShouldBeNil)
+		So(vals, ShouldHaveLength, 2)
+		So(vals[1].Get("FieldB"), ShouldEqual, "b")
+
+		vals, err = decodeAll(`[]`)
+		So(err, ShouldBeNil)
+		So(vals, ShouldBeEmpty)
+	})
+
+	Convey("reuse value", t, func() {
+		dec := typ.NewDecoder(strings.NewReader(`[{"FieldA":1,"FieldB":"a"},{"FieldA":2}]`))
+		val := typ.New()
+		m := val.value
+		So(dec.Decode(&val), ShouldBeNil)
+		So(val.Get("FieldB"), ShouldEqual, "a")
+		So(dec.Decode(&val), ShouldBeNil)
+		So(val.Get("FieldA"), ShouldEqual, 2)
+		So(val.Get("FieldB"), ShouldEqual, "")
+		So(reflect.ValueOf(val.value).Pointer(), ShouldEqual, reflect.ValueOf(m).Pointer())
+	})
+
+	Convey("decode error", t, func() {
+		dec := typ.NewDecoder(strings.NewReader(`{"FieldA":1} {"FieldA":"x"} {"FieldA":3} {"FieldA":}`))
+		var val Value
+		So(dec.Decode(&val), ShouldBeNil)
+		err := dec.Decode(&val)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "record 1 at offset 13: ")
+		de, ok := err.(DecodeError)
+		So(ok, ShouldBeTrue)
+		So(de.Index, ShouldEqual, 1)
+		So(de.Offset, ShouldEqual, 13)
+		So(de.Err, ShouldNotBeNil)
+		So(dec.Decode(&val), ShouldBeNil)
+		So(val.Get("FieldA"), ShouldEqual, 3)
+		err = dec.Decode(&val)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "record 3 at offset ")
+	})
+
+	Convey("limits apply while records are read", t, func() {
+		dec := typ.NewDecoder(io.MultiReader(strings.NewReader(`{"FieldA":1} {"FieldB":"`), endlessReader('x')))
+		dec.SetOptions(DecodeOptions{MaxBytes: 64})
+		var val Value
+		So(dec.Decode(&val), ShouldBeNil)
+		So(dec.More(), ShouldBeTrue)
+		err := dec.Decode(&val)
+		So(err, ShouldBeError, `record 1 at offset 13: invalid json: maximum size exceeded (64) at offset 64`)
+		So(errors.Is(err, ErrMaxBytes), ShouldBeTrue)
+
+		dec = typ.NewDecoder(io.MultiReader(strings.NewReader(`[{"FieldA":`), endlessReader('[')))
+		dec.SetOptions(DecodeOptions{MaxDepth: 3})
+		err = dec.Decode(&val)
+		So(err, ShouldBeError, `record 0 at offset 1: invalid json: maximum depth exceeded (3) at offset 12`)
+		So(errors.Is(err, ErrMaxDepth), ShouldBeTrue)
+	})
+}
+
+// endlessReader reads its byte forever.
+type endlessReader byte
+
+func (r endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestDecodeOptions(t *testing.T) {
+	inner, _ := Define("Inner").AddField("Field", reflect.TypeOf(int(0))).Finish()
+	typ, err := Define("Abc").
+		AddField("FieldA", reflect.TypeOf(int(0)), Required()).
+		AddField("FieldB", reflect.TypeOf((*interface{})(nil)).Elem()).
+		AddField("Inner", PtrTo(inner)).
+		Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("default options", t, func() {
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"FieldA":1,"FieldA":2,"FieldC":3,"FieldB":4}`)), ShouldBeNil)
+		So(val.Get("FieldA"), ShouldEqual, 1)
+		So(val.Get("FieldB"), ShouldEqual, float64(4))
+		So(val.UnmarshalJSON([]byte(`{"FieldB":4}`)), ShouldBeError, `type "dynstruct.Abc" missing required key "FieldA"`)
+		So(val.UnmarshalJSON([]byte(`{"FieldB":4}`)), ShouldResemble, MissingKeyError{Type: "dynstruct.Abc", Key: "FieldA"})
+	})
+
+	Convey("disallow unknown fields", t, func() {
+		val := typ.New()
+		opts := DecodeOptions{DisallowUnknownFields: true}
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"FieldC":3}`), opts), ShouldBeError, `type "dynstruct.Abc" has no field for key "FieldC"`)
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"Inner":{"Other":1}}`), opts), ShouldBeError, `type "dynstruct.Inner" has no field for key "Other"`)
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"Inner":{"Other":1}}`), opts), ShouldResemble, UnknownKeyError{Type: "dynstruct.Inner", Key: "Other"})
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"Inner":{"Field":1}}`), opts), ShouldBeNil)
+	})
+
+	Convey("options cannot change after Finish", t, func() {
+		codec := &countingCodec{Codec: StdCodec}
+		d := Define("Late").AddField("A", reflect.TypeOf(0)).WithCodec(codec)
+		typ, err := d.Finish()
+		So(err, ShouldBeNil)
+		d.WithDecodeOptions(DecodeOptions{DisallowUnknownFields: true}).WithCodec(nil).WithNaming(SnakeCase)
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"A":1,"B":2}`)), ShouldBeNil)
+		So(val.Get("A"), ShouldEqual, 1)
+		So(typ.self.decodeOpts.codec, ShouldEqual, codec)
+	})
+
+	Convey("reject duplicate keys", t, func() {
+		val := typ.New()
+		opts := DecodeOptions{RejectDuplicateKeys: true}
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"FieldA":2}`), opts), ShouldBeError, `type "dynstruct.Abc" got duplicate key "FieldA"`)
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"FieldA":2}`), opts), ShouldResemble, DuplicateKeyError{Type: "dynstruct.Abc", Key: "FieldA"})
+	})
+
+	Convey("require all fields", t, func() {
+		val := typ.New()
+		opts := DecodeOptions{RequireAllFields: true}
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"FieldB":null}`), opts), ShouldBeError, `type "dynstruct.Abc" missing required key "Inner"`)
+		So(val.UnmarshalJSONOptions([]byte(`{"FieldA":1,"FieldB":null,"Inner":null}`), opts), ShouldBeNil)
+	})
+
+	Convey("use number", t, func() {
+		strict, err := Define("Abc").
+			AddField("FieldB", reflect.TypeOf((*interface{})(nil)).Elem()).
+			WithDecodeOptions(DecodeOptions{UseNumber: true}).
+			Finish()
+		So(err, ShouldBeNil)
+		val := strict.New()
+		So(json.Unmarshal([]byte(`{"FieldB":12345678901234567890}`), &val), ShouldBeNil)
+		So(val.Get("FieldB"), ShouldEqual, stdjson.Number("12345678901234567890"))
+
+		dec := strict.NewDecoder(strings.NewReader(`{"FieldB":1,"FieldC":2}`))
+		dec.SetOptions(DecodeOptions{DisallowUnknownFields: true})
+		So(dec.Decode(&val), ShouldBeError, `record 0 at offset 0: type "dynstruct.Abc" has no field for key "FieldC"`)
+	})
+}
+
+func TestKeyMatching(t *testing.T) {
+	typ, err := Define("Abc").
+		AddField("UserID", reflect.TypeOf(int(0)), Aliases("userId", "user_id")).
+		AddField("Name", reflect.TypeOf("")).
+		Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("exact matching", t, func() {
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"user_id":1,"name":"a"}`)), ShouldBeNil)
+		So(val.Get("UserID"), ShouldEqual, 1)
+		So(val.Get("Name"), ShouldEqual, "")
+		So(val.UnmarshalJSON([]byte(`{"userId":2,"UserID":3}`)), ShouldBeNil)
+		So(val.Get("UserID"), ShouldEqual, 2)
+		So(val.UnmarshalJSONOptions([]byte(`{"userId":2,"UserID":3}`), DecodeOptions{RejectDuplicateKeys: true}),
+			ShouldBeError, `type "dynstruct.Abc" got duplicate key "UserID"`)
+	})
+
+	Convey("case-insensitive matching", t, func() {
+		val := typ.New()
+		opts := DecodeOptions{KeyMatching: MatchCaseInsensitive}
+		So(val.UnmarshalJSONOptions([]byte(`{"USER_ID":1,"name":"a"}`), opts), ShouldBeNil)
+		So(val.Get("UserID"), ShouldEqual, 1)
+		So(val.Get("Name"), ShouldEqual, "a")
+	})
+
+	Convey("match map keys", t, func() {
+		val, err := typ.NewFromMap(map[string]interface{}{"user_id": 1, "name": "a"})
+		So(err, ShouldBeNil)
+		So(val.Get("UserID"), ShouldEqual, 1)
+		So(val.Get("Name"), ShouldEqual, "")
+		val, err = typ.NewFromMapStrictly(map[string]interface{}{"userId": 1, "UserID": 2})
+		So(err, ShouldBeNil)
+		So(val.Get("UserID"), ShouldEqual, 2)
+		_, err = typ.NewFromMap(map[string]interface{}{"userId": "1"})
+		So(err, ShouldBeError, `field "UserID" of type "dynstruct.Abc" unmatched type: expected "int", got "string"`)
+
+		folding, err := Define("Abc").
+			AddField("Name", reflect.TypeOf("")).
+			WithDecodeOptions(DecodeOptions{KeyMatching: MatchCaseInsensitive}).
+			Finish()
+		So(err, ShouldBeNil)
+		val, err = folding.NewFromMapStrictly(map[string]interface{}{"NAME": "a"})
+		So(err, ShouldBeNil)
+		So(val.Get("Name"), ShouldEqual, "a")
+	})
+
+	Convey("repeated alias", t, func() {
+		_, err := Define("Abc").
+			AddField("A", reflect.TypeOf(0), Aliases("a")).
+			AddField("B", reflect.TypeOf(0), Aliases("A")).
+			Finish()
+		So(err, ShouldBeError, `repeated key name: "A"`)
+	})
+}
+
+func TestNaming(t *testing.T) {
+	Convey("naming strategies", t, func() {
+		cases := []struct{ name, snake, kebab, camel string }{
+			{"UserID", "user_id", "user-id", "userID"},
+			{"HTTPServer", "http_server", "http-server", "httpServer"},
+			{"Field2Name", "field2_name", "field2-name", "field2Name"},
+			{"ID", "id", "id", "id"},
+			{"already_snake", "already_snake", "already-snake", "already_snake"},
+		}
+		for _, c := range cases {
+			So(SnakeCase(c.name), ShouldEqual, c.snake)
+			So(KebabCase(c.name), ShouldEqual, c.kebab)
+			So(CamelCase(c.name), ShouldEqual, c.camel)
+		}
+	})
+
+	Convey("marshal and unmarshal named keys", t, func() {
+		inner, err := Define("Inner").
+			AddField("CreatedAt", reflect.TypeOf(0)).
+			WithNaming(CamelCase).
+			Finish()
+		So(err, ShouldBeNil)
+		typ, err := Define("Abc").
+			AddField("UserID", reflect.TypeOf(0)).
+			AddField("DisplayName", reflect.TypeOf(""), Key("name")).
+			AddField("Inner", inner).
+			WithNaming(SnakeCase).
+			Finish()
+		So(err, ShouldBeNil)
+
+		val := typ.New()
+		data := `{"user_id":1,"name":"a","inner":{"createdAt":2}}`
+		So(val.UnmarshalJSON([]byte(data)), ShouldBeNil)
+		So(val.Get("UserID"), ShouldEqual, 1)
+		So(val.Get("DisplayName"), ShouldEqual, "a")
+		So(val.Get("Inner").(Value).Get("CreatedAt"), ShouldEqual, 2)
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, data)
+
+		So(val.UnmarshalJSONOptions([]byte(`{"user_id":1}`), DecodeOptions{RequireAllFields: true}),
+			ShouldBeError, `type "dynstruct.Abc" missing required key "name"`)
+	})
+
+	Convey("named keys of embedded fields", t, func() {
+		base, _ := Define("Base").AddField("CreatedAt", reflect.TypeOf(0)).WithNaming(SnakeCase).Finish()
+		typ, err := Define("Abc").Embed(base).AddField("Name", reflect.TypeOf("")).Finish()
+		So(err, ShouldBeNil)
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"created_at":1,"Name":"a"}`)), ShouldBeNil)
+		So(val.Get("CreatedAt"), ShouldEqual, 1)
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, `{"created_at":1,"Name":"a"}`)
+	})
+
+	Convey("repeated key", t, func() {
+		_, err := Define("Abc").
+			AddField("UserID", reflect.TypeOf(0)).
+			AddField("User_ID", reflect.TypeOf(0)).
+			WithNaming(SnakeCase).
+			Finish()
+		So(err, ShouldBeError, `repeated key name: "user_id"`)
+	})
+}
+
+func TestUnknownFields(t *testing.T) {
+	inner, _ := Define("Inner").AddField("Field", reflect.TypeOf(0)).Finish()
+	typ, err := Define("Abc").
+		AddField("FieldA", reflect.TypeOf(0)).
+		AddField("Inner", inner).
+		WithDecodeOptions(DecodeOptions{KeepUnknownFields: true}).
+		Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("keep unknown fields", t, func() {
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"z":[1, 2],"FieldA":1,"a\"b":{"x":null},"Inner":{"Field":2,"y":true}}`)), ShouldBeNil)
+		So(val.Get("FieldA"), ShouldEqual, 1)
+		So(val.UnknownFields(), ShouldResemble, []RawField{
+			{Key: "z", Value: []byte("[1, 2]")},
+			{Key: `a\"b`, Value: []byte(`{"x":null}`)},
+		})
+		So(val.Get("Inner").(Value).UnknownFields(), ShouldResemble, []RawField{{Key: "y", Value: []byte("true")}})
+
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, `{"FieldA":1,"Inner":{"Field":2,"y":true},"z":[1, 2],"a\"b":{"x":null}}`)
+		So(val.Copy().UnknownFields(), ShouldHaveLength, 2)
+		So(val.DeepCopy().UnknownFields(), ShouldHaveLength, 2)
+
+		So(val.UnmarshalJSON([]byte(`{"FieldA":1}`)), ShouldBeNil)
+		So(val.UnknownFields(), ShouldBeNil)
+		So(val.UnmarshalJSONOptions([]byte(`{"z":1}`), DecodeOptions{}), ShouldBeNil)
+		So(val.UnknownFields(), ShouldBeNil)
+	})
+
+	Convey("keep unknown fields next to embedded fields", t, func() {
+		embedding, err := Define("Embedding").
+			Embed(inner).
+			WithDecodeOptions(DecodeOptions{KeepUnknownFields: true}).
+			Finish()
+		So(err, ShouldBeNil)
+		val := embedding.New()
+		So(val.UnmarshalJSON([]byte(`{"Field":1,"z":2}`)), ShouldBeNil)
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, `{"Field":1,"z":2}`)
+	})
+}
+
+func TestLazy(t *testing.T) {
+	inner, _ := Define("Inner").AddField("Field", reflect.TypeOf(0)).Finish()
+	typ, err := Define("Abc").
+		AddField("FieldA", reflect.TypeOf(0)).
+		AddField("FieldB", reflect.TypeOf("")).
+		AddField("Inner", inner).
+		AddField("Inners", SliceOf(inner)).
+		WithDecodeOptions(DecodeOptions{Lazy: true}).
+		Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("lazy decoding", t, func() {
+		data := []byte(`{"FieldA": 1, "FieldB": "x\u0041", "Inner": {"Field": 2}, "Inners": [{"Field": 3}]}`)
+		val := typ.New()
+		So(val.UnmarshalJSON(data), ShouldBeNil)
+		So(val.value["FieldA"], ShouldHaveSameTypeAs, &lazyField{})
+		copy(data, "{\"FieldB\"")
+
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, `{"FieldA":1,"FieldB":"x\u0041","Inner":{"Field": 2},"Inners":[{"Field": 3}]}`)
+
+		So(val.Get("FieldA"), ShouldEqual, 1)
+		So(val.value["FieldA"], ShouldEqual, 1)
+		var b string
+		val.Scan("FieldB", &b)
+		So(b, ShouldEqual, "xA")
+		So(val.Get("Inner").(Value).Get("Field"), ShouldEqual, 2)
+		So(val.Get("Inners").([]Value)[0].Get("Field"), ShouldEqual, 3)
+		d, err = val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, `{"FieldA":1,"FieldB":"xA","Inner":{"Field":2},"Inners":[{"Field":3}]}`)
+	})
+
+	Convey("lazy decoding errors", t, func() {
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"FieldA":"x","FieldB":"b"}`)), ShouldBeNil)
+		So(val.Copy().Get("FieldB"), ShouldEqual, "b")
+		So(val.DeepCopy().Get("FieldB"), ShouldEqual, "b")
+		So(func() { val.Get("FieldA") }, ShouldPanic)
+		So(val.Resolve(), ShouldNotBeNil)
+	})
+}
+
+func TestNumbers(t *testing.T) {
+	typ, err := Define("Abc").
+		AddField("Int", reflect.TypeOf(int(0))).
+		AddField("Int8", reflect.TypeOf(int8(0))).
+		AddField("Uint", reflect.TypeOf(uint(0))).
+		AddField("Uint64", reflect.TypeOf(uint64(0))).
+		AddField("Uintptr", reflect.TypeOf(uintptr(0))).
+		AddField("Age", reflect.TypeOf(testAge(0))).
+		AddField("Float32", reflect.TypeOf(float32(0))).
+		AddField("Bool", reflect.TypeOf(false)).
+		AddField("Number", reflect.TypeOf(stdjson.Number(""))).
+		AddField("BigInt", reflect.TypeOf(big.Int{})).
+		AddField("BigFloat", reflect.TypeOf((*big.Float)(nil))).
+		AddField("IntPtr", reflect.TypeOf((*int)(nil))).
+		Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("decode numbers faithfully", t, func() {
+		val := typ.New()
+		err := val.UnmarshalJSON([]byte(`{"Int":1e3,"Int8":-128,"Uint":42,"Uint64":18446744073709551615,
+			"Uintptr":7,"Age":2.0E1,"Float32":1.5,"Bool":true,"Number":1.50,
+			"BigInt":123456789012345678901234567890,"BigFloat":0.1000000000000000000001,"IntPtr":5}`))
+		So(err, ShouldBeNil)
+		So(val.Get("Int"), ShouldEqual, 1000)
+		So(val.Get("Int8"), ShouldEqual, int8(-128))
+		So(val.Get("Uint"), ShouldEqual, uint(42))
+		So(val.Get("Uint64"), ShouldEqual, uint64(math.MaxUint64))
+		So(val.Get("Uintptr"), ShouldEqual, uintptr(7))
+		So(val.Get("Age"), ShouldEqual, testAge(20))
+		So(val.Get("Float32"), ShouldEqual, float32(1.5))
+		So(val.Get("Bool"), ShouldEqual, true)
+		So(val.Get("Number"), ShouldEqual, stdjson.Number("1.50"))
+		bi := val.Get("BigInt").(big.Int)
+		So(bi.String(), ShouldEqual, "123456789012345678901234567890")
+		So(val.Get("BigFloat").(*big.Float).Text('g', 22), ShouldEqual, "0.1000000000000000000001")
+		So(*val.Get("IntPtr").(*int), ShouldEqual, 5)
+
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		decoded := typ.New()
+		So(decoded.UnmarshalJSON(d), ShouldBeNil)
+		So(decoded.Get("BigFloat").(*big.Float).Cmp(val.Get("BigFloat").(*big.Float)), ShouldEqual, 0)
+
+		So(val.UnmarshalJSON([]byte(`{"IntPtr":null,"Int":null}`)), ShouldBeNil)
+		So(val.Get("IntPtr"), ShouldBeNil)
+		So(val.Get("Int"), ShouldEqual, 0)
+	})
+
+	Convey("encode big numbers held by value", t, func() {
+		typ, err := Define("Big").
+			AddField("Int", reflect.TypeOf(big.Int{})).
+			AddField("Float", reflect.TypeOf(big.Float{})).
+			Finish()
+		So(err, ShouldBeNil)
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"Int":123456789012345678901234567890,"Float":0.1000000000000000000001}`)), ShouldBeNil)
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, `{"Int":123456789012345678901234567890,"Float":"0.1000000000000000000001"}`)
+
+		decoded := typ.New()
+		So(decoded.UnmarshalJSON(d), ShouldBeNil)
+		bi, di := val.Get("Int").(big.Int), decoded.Get("Int").(big.Int)
+		So(di.Cmp(&bi), ShouldEqual, 0)
+		bf, df := val.Get("Float").(big.Float), decoded.Get("Float").(big.Float)
+		So(df.Cmp(&bf), ShouldEqual, 0)
+	})
+
+	Convey("decode errors name the field", t, func() {
+		val := typ.New()
+		cases := []struct{ json, err string }{
+			{`{"Int8":128}`, `field "Int8" cannot decode 128 into "int8": value out of range`},
+			{`{"Uint":-1}`, `field "Uint" cannot decode -1 into "uint": value out of range`},
+			{`{"Age":1.5}`, `field "Age" cannot decode 1.5 into "dynstruct.testAge": not an integer`},
+			{`{"Int":"1"}`, `field "Int" cannot decode "1" into "int": invalid syntax`},
+			{`{"Float32":1e39}`, `field "Float32" cannot decode 1e39 into "float32": value out of range`},
+			{`{"Bool":1}`, `field "Bool" cannot decode 1 into "bool": invalid syntax`},
+			{`{"BigInt":1e100000000}`, `field "BigInt" cannot decode 1e100000000 into "big.Int": value out of range`},
+			{`{"Uint64":123456789012345678901234567890123456789}`,
+				`field "Uint64" cannot decode 12345678901234567890123456789012... into "uint64": value out of range`},
+		}
+		for _, c := range cases {
+			So(val.UnmarshalJSON([]byte(c.json)), ShouldBeError, c.err)
+		}
+		err := val.UnmarshalJSON([]byte(`{"Int8":128}`))
+		So(errors.Is(err, strconv.ErrRange), ShouldBeTrue)
+	})
+}
+
+func TestCustomUnmarshaler(t *testing.T) {
+	Convey("custom unmarshalers", t, func() {
+		typ, err := Define("Abc").
+			AddField("ID", reflect.TypeOf(testID(0))).
+			AddField("Status", reflect.TypeOf(testStatus(""))).
+			AddField("StatusPtr", reflect.TypeOf((*testStatus)(nil))).
+			AddField("Time", reflect.TypeOf(time.Time{})).
+			AddField("Any", Union(testID(0), "")).
+			Finish()
+		So(err, ShouldBeNil)
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"ID":"id-3","Status":2,"StatusPtr":1,"Time":"2000-01-02T03:04:05Z","Any":"id-4"}`)), ShouldBeNil)
+		So(val.Get("ID"), ShouldEqual, testID(3))
+		So(val.Get("Status"), ShouldEqual, testStatus("**"))
+		So(*val.Get("StatusPtr").(*testStatus), ShouldEqual, testStatus("*"))
+		So(val.Get("Time"), ShouldEqual, time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC))
+		So(val.Get("Any"), ShouldEqual, testID(4))
+
+		d, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(d), ShouldEqual, `{"ID":"id-3","Status":2,"StatusPtr":1,"Time":"2000-01-02T03:04:05Z","Any":"id-4"}`)
+
+		So(val.UnmarshalJSON([]byte(`{"ID":"x"}`)), ShouldNotBeNil)
+	})
+}
+
+func TestSyntaxError(t *testing.T) {
+	typ, _ := Define("Abc").AddField("FieldA", reflect.TypeOf(0)).Finish()
+
+	Convey("syntax errors locate the offending character", t, func() {
+		val := typ.New()
+		err := val.UnmarshalJSON([]byte("{\n  \"FieldA\": 1,\n  \"FieldB\": tru\n}"))
+		So(err, ShouldBeError, `invalid json: unexpected character '\n' at line 3, column 16 (offset 32)`)
+		var se *SyntaxError
+		So(errors.As(err, &se), ShouldBeTrue)
+		So(se.Offset, ShouldEqual, 32)
+		So(se.Line, ShouldEqual, 3)
+		So(se.Column, ShouldEqual, 16)
+		So(se.Char, ShouldEqual, '\n')
+		So(se.State, ShouldEqual, "T3")
+		So(se.Mode, ShouldEqual, "OBJECT")
+
+		err = val.UnmarshalJSON([]byte(`{"FieldA":1,é}`))
+		So(err, ShouldBeError, `invalid json: unexpected character 'é' at line 1, column 13 (offset 12)`)
+
+		err = val.UnmarshalJSON([]byte(`{"FieldA":[1`))
+		So(err, ShouldBeError, `invalid json: unexpected end of input at line 1, column 13 (offset 12)`)
+	})
+}
+
+func TestTokenizer(t *testing.T) {
+	data := "{\"a\": [1, -2.5e3, \"x\\\"y\"], \"b\": {\"c\": true, \"d\": null}, \"e\": false}\n[] 42 \"s\""
+	type tok struct {
+		kind  TokenKind
+		depth int
+		text  string
+	}
+	expected := []tok{
+		{TokenObjectBegin, 0, "{"},
+		{TokenKey, 1, `"a"`},
+		{TokenArrayBegin, 1, "["},
+		{TokenNumber, 2, "1"},
+		{TokenNumber, 2, "-2.5e3"},
+		{TokenString, 2, `"x\"y"`},
+		{TokenArrayEnd, 1, "]"},
+		{TokenKey, 1, `"b"`},
+		{TokenObjectBegin, 1, "{"},
+		{TokenKey, 2, `"c"`},
+		{TokenTrue, 2, "true"},
+		{TokenKey, 2, `"d"`},
+		{TokenNull, 2, "null"},
+		{TokenObjectEnd, 1, "}"},
+		{TokenKey, 1, `"e"`},
+		{TokenFalse, 1, "false"},
+		{TokenObjectEnd, 0, "}"},
+		{TokenArrayBegin, 0, "["},
+		{TokenArrayEnd, 0, "]"},
+		{TokenNumber, 0, "42"},
+		{TokenString, 0, `"s"`},
+	}
+	tokenize := func(tz *Tokenizer, data string) ([]tok, error) {
+		var toks []tok
+		for {
+			token, err := tz.Next()
+			if err == io.EOF {
+				return toks, nil
+			}
+			if err != nil {
+				return toks, err
+			}
+			So(string(tz.Bytes()), ShouldEqual, data[token.Start:token.End])
+			toks = append(toks, tok{token.Kind, token.Depth, string(tz.Bytes())})
+		}
+	}
+
+	Convey("tokenize bytes", t, func() {
+		toks, err := tokenize(NewBytesTokenizer([]byte(data)), data)
+		So(err, ShouldBeNil)
+		So(toks, ShouldResemble, expected)
+	})
+
+	Convey("tokenize a reader byte by byte", t, func() {
+		toks, err := tokenize(NewTokenizer(iotest.OneByteReader(strings.NewReader(data))), data)
+		So(err, ShouldBeNil)
+		So(toks, ShouldResemble, expected)
+	})
+
+	Convey("skip subtrees", t, func() {
+		tz := NewBytesTokenizer([]byte(data))
+		var keys []string
+		for {
+			token, err := tz.Next()
+			So(err, ShouldBeNil)
+			if token.Kind == TokenObjectEnd && token.Depth == 0 {
+				break
+			}
+			if token.Kind == TokenKey {
+				keys = append(keys, string(tz.Bytes()))
+				So(tz.Skip(), ShouldBeNil)
+			}
+		}
+		So(keys, ShouldResemble, []string{`"a"`, `"b"`, `"e"`})
+		token, err := tz.Next()
+		So(err, ShouldBeNil)
+		So(token.Kind, ShouldEqual, TokenArrayBegin)
+		So(tz.Skip(), ShouldBeNil)
+		token, err = tz.Next()
+		So(err, ShouldBeNil)
+		So(string(tz.Bytes()), ShouldEqual, "42")
+	})
+
+	Convey("tokenize invalid JSON", t, func() {
+		invalid := "{\"a\":\n [1,]}"
+		_, err := tokenize(NewBytesTokenizer([]byte(invalid)), invalid)
+		So(err, ShouldBeError, `invalid json: unexpected character ']' at line 2, column 5 (offset 10)`)
+
+		invalid = `{"a":[1`
+		_, err = tokenize(NewBytesTokenizer([]byte(invalid)), invalid)
+		So(err, ShouldBeError, `invalid json: unexpected end of input at line 1, column 8 (offset 7)`)
+	})
+}
+
+func TestExtractJSON(t *testing.T) {
+	data := []byte(`{"meta": {"user": {"id": 7, "name": "x"}, "tags": ["a", {"key": [1, 2]}]}, "body": {"big": [1, 2, 3]}, "n": null}`)
+
+	Convey("extract the values at paths", t, func() {
+		values, err := ExtractJSON(data, "meta.user.id", "meta.tags[1].key[1]", "meta.user", "n", "body.missing", "meta.tags[5]", "")
+		So(err, ShouldBeNil)
+		So(string(values[0]), ShouldEqual, `7`)
+		So(string(values[1]), ShouldEqual, `2`)
+		So(string(values[2]), ShouldEqual, `{"id": 7, "name": "x"}`)
+		So(string(values[3]), ShouldEqual, `null`)
+		So(values[4], ShouldBeNil)
+		So(values[5], ShouldBeNil)
+		So(string(values[6]), ShouldEqual, string(data))
+
+		values, err = ExtractJSON([]byte(` [{"a": 1}, {"a": "b"}] `), "[1].a", "[0]")
+		So(err, ShouldBeNil)
+		So(string(values[0]), ShouldEqual, `"b"`)
+		So(string(values[1]), ShouldEqual, `{"a": 1}`)
+	})
+
+	Convey("invalid paths and JSON", t, func() {
+		for _, path := range []string{"a..b", ".a", "a[", "a[x]", "a[-1]", "a.[0]", "a[0]b"} {
+			_, err := ExtractJSON(data, path)
+			So(err, ShouldBeError, fmt.Sprintf("invalid path %#v", path))
+		}
+		_, err := ExtractJSON([]byte(`{"a": [1, }`), "b")
+		So(err, ShouldBeError, `invalid json: unexpected character '}' at line 1, column 11 (offset 10)`)
+		_, err = ExtractJSON([]byte(`{"a": 1} 2`), "b")
+		So(err, ShouldBeError, `invalid json: unexpected character '2' at line 1, column 10 (offset 9)`)
+		_, err = ExtractJSON([]byte(``), "b")
+		So(err, ShouldBeError, `invalid json: unexpected end of input at line 1, column 1 (offset 0)`)
+	})
+
+	Convey("decode a nested value", t, func() {
+		user, _ := Define("User").AddField("id", reflect.TypeOf(0)).AddField("name", reflect.TypeOf("")).Finish()
+		val := user.New()
+		So(val.UnmarshalJSONPath(data, "meta.user"), ShouldBeNil)
+		So(val.Get("id"), ShouldEqual, 7)
+		So(val.Get("name"), ShouldEqual, "x")
+		So(val.UnmarshalJSONPath(data, "meta.owner"), ShouldBeError, `no value at path "meta.owner"`)
+	})
+}
+
+func TestLenient(t *testing.T) {
+	typ, _ := Define("Config").
+		AddField("Name", reflect.TypeOf("")).
+		AddField("Ports", reflect.TypeOf([]int{})).
+		WithDecodeOptions(DecodeOptions{Lenient: true}).
+		Finish()
+	data := []byte(`// service config
+{
+	/* the "name" */ Name: 'it\'s "here"',
+	Ports: [80, 443, /* more later */],
+	$unknown_1: {a: 'b',}, // trailing comma
+}`)
+
+	Convey("lenient JSON is made strict", t, func() {
+		val := typ.New()
+		So(val.UnmarshalJSON(data), ShouldBeNil)
+		So(val.Get("Name"), ShouldEqual, `it's "here"`)
+		So(val.Get("Ports"), ShouldResemble, []int{80, 443})
+
+		strict := typ.New()
+		err := strict.UnmarshalJSONOptions(data, DecodeOptions{})
+		So(err, ShouldBeError, `invalid json: unexpected character '/' at line 1, column 1 (offset 0)`)
+	})
+
+	Convey("syntax errors locate the character in the lenient JSON", t, func() {
+		val := typ.New()
+		err := val.UnmarshalJSON([]byte("{Name: 'a\"b', Ports: [1,,]}"))
+		So(err, ShouldBeError, `invalid json: unexpected character ',' at line 1, column 25 (offset 24)`)
+		err = val.UnmarshalJSON([]byte("{Ports: [,],}"))
+		So(err, ShouldBeError, `invalid json: unexpected character ',' at line 1, column 10 (offset 9)`)
+		err = val.UnmarshalJSON([]byte("{,}"))
+		So(err, ShouldBeError, `invalid json: unexpected character ',' at line 1, column 2 (offset 1)`)
+		err = val.UnmarshalJSON([]byte("{Name: 'a' /* open"))
+		So(err, ShouldBeError, `invalid json: unexpected end of input at line 1, column 19 (offset 18)`)
+		err = val.UnmarshalJSON([]byte("{Name: 'a}"))
+		So(err, ShouldBeError, `invalid json: unexpected end of input at line 1, column 11 (offset 10)`)
+		err = val.UnmarshalJSON([]byte("{Name: a}"))
+		So(err, ShouldBeError, `invalid json: unexpected character 'a' at line 1, column 8 (offset 7)`)
+	})
+}
+
+func TestDecodeLimits(t *testing.T) {
+	typ, _ := Define("Doc").
+		AddField("Name", reflect.TypeOf("")).
+		AddField("Data", reflect.TypeOf((*interface{})(nil)).Elem()).
+		Finish()
+	data := []byte(`{"Name": "abcdef", "Data": {"a": [[1]], "b": 2}}`)
+
+	Convey("documents within the limits decode", t, func() {
+		val := typ.New()
+		opts := DecodeOptions{MaxDepth: 4, MaxBytes: len(data), MaxKeys: 4, MaxStringLen: 6}
+		So(val.UnmarshalJSONOptions(data, opts), ShouldBeNil)
+		So(val.Get("Name"), ShouldEqual, "abcdef")
+	})
+
+	Convey("exceeding a limit fails with a distinct error", t, func() {
+		cases := []struct {
+			opts   DecodeOptions
+			target error
+			msg    string
+		}{
+			{DecodeOptions{MaxDepth: 3}, ErrMaxDepth, `invalid json: maximum depth exceeded (3) at offset 34`},
+			{DecodeOptions{MaxBytes: 10}, ErrMaxBytes, `invalid json: maximum size exceeded (10) at offset 10`},
+			{DecodeOptions{MaxKeys: 3}, ErrMaxKeys, `invalid json: maximum number of keys exceeded (3) at offset 40`},
+			{DecodeOptions{MaxStringLen: 5}, ErrMaxStringLen, `invalid json: maximum string length exceeded (5) at offset 9`},
+		}
+		for _, c := range cases {
+			val := typ.New()
+			err := val.UnmarshalJSONOptions(data, c.opts)
+			So(err, ShouldBeError, c.msg)
+			So(errors.Is(err, c.target), ShouldBeTrue)
+			var le *LimitError
+			So(errors.As(err, &le), ShouldBeTrue)
+		}
+	})
+
+	Convey("limits apply to lenient JSON at its own offsets", t, func() {
+		val := typ.New()
+		err := val.UnmarshalJSONOptions([]byte(`{Name: 'x', Data: {a: 1, b: 2}}`), DecodeOptions{Lenient: true, MaxKeys: 3})
+		So(err, ShouldBeError, `invalid json: maximum number of keys exceeded (3) at offset 25`)
+	})
+}
+
+func TestValueSlice(t *testing.T) {
+	typ, _ := Define("Item").AddField("ID", reflect.TypeOf(0)).AddField("Name", reflect.TypeOf("")).Finish()
+	other, _ := Define("Other").AddField("ID", reflect.TypeOf(0)).Finish()
+
+	Convey("decode and encode an array of Values", t, func() {
+		s := typ.NewSlice()
+		So(json.Unmarshal([]byte(` [{"ID": 2, "Name": "b"}, null, {"ID": 1, "Name": "a"}] `), s), ShouldBeNil)
+		So(s.Len(), ShouldEqual, 3)
+		So(s.At(0).Get("Name"), ShouldEqual, "b")
+		So(s.At(1).Get("ID"), ShouldEqual, 0)
+
+		s.Sort(func(a, b Value) bool { return a.Get("ID").(int) < b.Get("ID").(int) })
+		data, err := json.Marshal(s)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `[{"ID":0,"Name":""},{"ID":1,"Name":"a"},{"ID":2,"Name":"b"}]`)
+
+		empty := typ.NewSlice()
+		So(empty.UnmarshalJSON([]byte(`[]`)), ShouldBeNil)
+		So(empty.Len(), ShouldEqual, 0)
+		data, _ = empty.MarshalJSON()
+		So(string(data), ShouldEqual, `[]`)
+		So(empty.UnmarshalJSON([]byte(`null`)), ShouldBeNil)
+		data, _ = empty.MarshalJSON()
+		So(string(data), ShouldEqual, `null`)
+
+		var zero ValueSlice
+		data, err = zero.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `null`)
+	})
+
+	Convey("append checks the type of the Values", t, func() {
+		s := typ.NewSlice(typ.New())
+		s.Append(typ.New(), typ.New())
+		So(s.Len(), ShouldEqual, 3)
+		So(func() { s.Append(other.New()) }, ShouldPanicWith, makeUnmatchedElemError(typ.self, other.self))
+
+		var zero ValueSlice
+		So(func() { zero.Append(Value{}) }, ShouldPanicWith, makeUnmatchedElemError(nil, nil))
+		So(zero.Len(), ShouldEqual, 0)
+		zero.Append(typ.New())
+		So(zero.Len(), ShouldEqual, 1)
+		So(func() { zero.Append(other.New()) }, ShouldPanicWith, makeUnmatchedElemError(typ.self, other.self))
+		data, err := zero.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `[{"ID":0,"Name":""}]`)
+	})
+
+	Convey("decoding errors locate the element", t, func() {
+		s := typ.NewSlice()
+		err := s.UnmarshalJSON([]byte(`[{"ID": 1}, {"ID": "x"}]`))
+		So(err, ShouldBeError, `record 1 at offset 12: field "ID" cannot decode "x" into "int": invalid syntax`)
+		So(s.UnmarshalJSON([]byte(`{"ID": 1}`)), ShouldBeError, `invalid json: unexpected character '{' at line 1, column 1 (offset 0)`)
+		So(s.UnmarshalJSON([]byte(`[1, 2]`)), ShouldNotBeNil)
+		So((&ValueSlice{}).UnmarshalJSON([]byte(`[]`)), ShouldEqual, makeUnknownTypeError())
+	})
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	inner, _ := Define("Inner").AddField("z", reflect.TypeOf("")).AddField("a", reflect.TypeOf(0.0)).Finish()
+	typ, _ := Define("Payload").
+		AddField("b", reflect.TypeOf(map[string]interface{}{})).
+		AddField("inner", inner).
+		AddField("a", reflect.TypeOf([]float64{})).
+		AddField("Euro", reflect.TypeOf(""), Key("€")).
+		AddField("Smile", reflect.TypeOf(true), Key("\U0001F600")).
+		Finish()
+	reordered, _ := Define("Payload").
+		AddField("Smile", reflect.TypeOf(true), Key("\U0001F600")).
+		AddField("Euro", reflect.TypeOf(""), Key("€")).
+		AddField("a", reflect.TypeOf([]float64{})).
+		AddField("inner", inner).
+		AddField("b", reflect.TypeOf(map[string]interface{}{})).
+		Finish()
+
+	fill := func(val Value) Value {
+		in := inner.New()
+		in.Set("z", "<tab>\t\u001f /é")
+		in.Set("a", 1e21)
+		val.Set("b", map[string]interface{}{"y": 1, "x": []interface{}{nil, false}})
+		val.Set("inner", in)
+		val.Set("a", []float64{0, -0.0, 1e-7, 0.000001, 123456789.5, -1.5e300, 100})
+		val.Set("Euro", "euro")
+		val.Set("Smile", true)
+		return val
+	}
+
+	Convey("canonical JSON does not depend on the declaration order", t, func() {
+		expected := `{"a":[0,0,1e-7,0.000001,123456789.5,-1.5e+300,100],"b":{"x":[null,false],"y":1},` +
+			`"inner":{"a":1e+21,"z":"<tab>\t\u001f` + " " + `/é"},"€":"euro","` + "\U0001F600" + `":true}`
+		data, err := fill(typ.New()).CanonicalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, expected)
+		data, err = fill(reordered.New()).CanonicalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, expected)
+	})
+
+	Convey("the encoder writes canonical JSON", t, func() {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		enc.SetCanonical(true)
+		val := inner.New()
+		val.Set("z", "x")
+		So(enc.BeginArray(), ShouldBeNil)
+		So(enc.Encode(val), ShouldBeNil)
+		So(enc.Encode(val), ShouldBeNil)
+		So(enc.EndArray(), ShouldBeNil)
+		So(buf.String(), ShouldEqual, `[{"a":0,"z":"x"},{"a":0,"z":"x"}]`+"\n")
+	})
+}
+
+type countingCodec struct {
+	Codec
+	marshals, unmarshals int
+}
+
+func (c *countingCodec) Marshal(v interface{}, escapeHTML bool) ([]byte, error) {
+	c.marshals++
+	return c.Codec.Marshal(v, escapeHTML)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}, opts DecodeOptions) error {
+	c.unmarshals++
+	return c.Codec.Unmarshal(data, v, opts)
+}
+
+func TestCodec(t *testing.T) {
+	type point struct {
+		X int    `json:"x"`
+		Y string `json:"y"`
+	}
+
+	Convey("fields are encoded and decoded through the codec of the DynStruct", t, func() {
+		codec := &countingCodec{Codec: StdCodec}
+		inner, _ := Define("Inner").AddField("P", reflect.TypeOf(point{})).Finish()
+		typ, _ := Define("Outer").
+			AddField("P", reflect.TypeOf(point{})).
+			AddField("N", reflect.TypeOf(0)).
+			AddField("Inner", inner).
+			WithCodec(codec).
+			Finish()
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"P": {"x": 1, "y": "<a>"}, "N": 2, "Inner": {"P": {"x": 3}}}`)), ShouldBeNil)
+		So(val.Get("P"), ShouldResemble, point{X: 1, Y: "<a>"})
+		So(val.Get("Inner").(Value).Get("P"), ShouldResemble, point{X: 3})
+		So(codec.unmarshals, ShouldEqual, 2)
+
+		data, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"P":{"x":1,"y":"\u003ca\u003e"},"N":2,"Inner":{"P":{"x":3,"y":""}}}`)
+		So(codec.marshals, ShouldEqual, 2)
+
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		So(enc.Encode(val), ShouldBeNil)
+		So(buf.String(), ShouldEqual, `{"P":{"x":1,"y":"<a>"},"N":2,"Inner":{"P":{"x":3,"y":""}}}`+"\n")
+		So(codec.marshals, ShouldEqual, 4)
+
+		err = val.UnmarshalJSONOptions([]byte(`{"P": {"x": 1, "z": 0}}`), DecodeOptions{DisallowUnknownFields: true})
+		So(err, ShouldBeError, `field "P" cannot decode {"x": 1, "z": 0} into "dynstruct.point": json: unknown field "z"`)
+		So(codec.unmarshals, ShouldEqual, 3)
+	})
+
+	Convey("the default codec applies to DynStructs without one", t, func() {
+		codec := &countingCodec{Codec: JSONIterCodec}
+		SetDefaultCodec(codec)
+		defer SetDefaultCodec(JSONIterCodec)
+		typ, _ := Define("Abc").AddField("P", reflect.TypeOf(point{})).Finish()
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"P": {"x": 1}}`)), ShouldBeNil)
+		_, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(codec.unmarshals, ShouldEqual, 1)
+		So(codec.marshals, ShouldEqual, 1)
+	})
+
+	Convey("escaped strings, slices of Values and canonical JSON go through the codec", t, func() {
+		codec := &countingCodec{Codec: StdCodec}
+		inner, _ := Define("Inner").AddField("S", reflect.TypeOf("")).Finish()
+		typ, _ := Define("Outer").
+			AddField("S", reflect.TypeOf("")).
+			AddField("Items", SliceOf(inner)).
+			WithCodec(codec).
+			Finish()
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"S": "a\u0026b", "Items": [{"S": "c"}]}`)), ShouldBeNil)
+		So(val.Get("S"), ShouldEqual, "a&b")
+		So(val.Get("Items").([]Value)[0].Get("S"), ShouldEqual, "c")
+		So(codec.unmarshals, ShouldEqual, 2)
+
+		data, err := val.CanonicalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"Items":[{"S":"c"}],"S":"a&b"}`)
+		So(codec.unmarshals, ShouldEqual, 3)
+	})
+
+	Convey("enum names go through the codec and the encoder options", t, func() {
+		codec := &countingCodec{Codec: StdCodec}
+		typ, _ := Define("Abc").AddField("E", Enum("<a>", "b")).WithCodec(codec).Finish()
+		val := typ.New()
+		So(val.UnmarshalJSON([]byte(`{"E": "\u003ca>"}`)), ShouldBeNil)
+		So(val.Get("E"), ShouldEqual, "<a>")
+		So(codec.unmarshals, ShouldEqual, 1)
+
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		So(enc.Encode(val), ShouldBeNil)
+		So(buf.String(), ShouldEqual, `{"E":"<a>"}`+"\n")
+		data, err := val.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"E":"\u003ca\u003e"}`)
+	})
+}
+
+func TestYAML(t *testing.T) {
+	type limits struct {
+		MaxConns int    `yaml:"max_conns"`
+		Timeout  string `yaml:"timeout,omitempty"`
+	}
+	meta, _ := Define("Meta").AddField("Team", reflect.TypeOf("")).Finish()
+	backend, _ := Define("Backend").AddField("Host", reflect.TypeOf("")).AddField("Weight", reflect.TypeOf(0)).Finish()
+	typ, _ := Define("Service").
+		Embed(meta).
+		AddField("Name", reflect.TypeOf("")).
+		AddField("Port", reflect.TypeOf(0)).
+		AddField("Level", Enum("debug", "info")).
+		AddField("Limits", reflect.TypeOf(limits{})).
+		AddField("Backends", SliceOf(backend)).
+		AddField("Primary", backend).
+		WithNaming(SnakeCase).
+		Finish()
+	data := `Team: core
+name: api
+port: 8080
+level: info
+limits:
+    max_conns: 100
+backends:
+    - Host: a
+      Weight: 1
+    - Host: b
+      Weight: 2
+primary:
+    Host: a
+    Weight: 1
+`
+
+	Convey("Values round-trip through YAML in declaration order", t, func() {
+		val := typ.New()
+		So(yaml.Unmarshal([]byte(data), &val), ShouldBeNil)
+		So(val.Get("Team"), ShouldEqual, "core")
+		So(val.Get("Port"), ShouldEqual, 8080)
+		So(val.Get("Level"), ShouldEqual, "info")
+		So(val.Get("Limits"), ShouldResemble, limits{MaxConns: 100})
+		So(val.Get("Backends").([]Value)[1].Get("Weight"), ShouldEqual, 2)
+		So(val.Get("Primary").(Value).Get("Host"), ShouldEqual, "a")
+
+		out, err := yaml.Marshal(val)
+		So(err, ShouldBeNil)
+		So(string(out), ShouldEqual, data)
+	})
+
+	Convey("type mismatches report their line", t, func() {
+		val := typ.New()
+		err := yaml.Unmarshal([]byte("name: api\nport: high\n"), &val)
+		So(err, ShouldBeError, `line 2: field "Port" cannot decode !!str into "int"`)
+		err = yaml.Unmarshal([]byte("name: api\nbackends:\n  - Host: a\n  - [b]\n"), &val)
+		So(err, ShouldBeError, `line 4: cannot decode !!seq into "dynstruct.Backend"`)
+		err = yaml.Unmarshal([]byte("level: trace\n"), &val)
+		So(err, ShouldBeError, `line 1: enum field "Level" has no member "trace"`)
+		err = yaml.Unmarshal([]byte("- name: api\n"), &val)
+		So(err, ShouldBeError, `line 1: cannot decode !!seq into "dynstruct.Service"`)
+	})
+
+	Convey("YAML decoding honors the decode options", t, func() {
+		strict, _ := Define("Strict").
+			AddField("Name", reflect.TypeOf(""), Required()).
+			WithDecodeOptions(DecodeOptions{DisallowUnknownFields: true}).
+			Finish()
+		val := strict.New()
+		So(yaml.Unmarshal([]byte("Name: a\nOther: b\n"), &val), ShouldBeError, makeUnknownKeyError(strict.self, "Other"))
+		So(yaml.Unmarshal([]byte("{}"), &val), ShouldBeError, makeMissingKeyError(strict.self, "Name"))
+	})
+
+	Convey("YAML encoding reports cycles", t, func() {
+		d := Define("Node")
+		node, err := d.AddField("Name", reflect.TypeOf("")).AddField("Next", PtrTo(d.Ref())).Finish()
+		So(err, ShouldBeNil)
+		a, b := node.New(), node.New()
+		a.Set("Name", "a")
+		b.Set("Name", "b")
+		a.Set("Next", &b)
+		out, err := yaml.Marshal(a)
+		So(err, ShouldBeNil)
+		So(string(out), ShouldEqual, "Name: a\nNext:\n    Name: b\n    Next: null\n")
+
+		b.Set("Next", &a)
+		_, err = yaml.Marshal(a)
+		So(err, ShouldBeError, `encountered a cycle via value of type "dynstruct.Node"`)
+	})
+}
+
+func BenchmarkMarshalJsonStruct(b *testing.B) {
+	b.ReportAllocs()
+	val := struct {
+		Field1 string
+		Field2 int
+		Field3 float64
+	}{
+		"abcdefg",
+		1234,
+		1234.5678,
+	}
+	for i := 0; i < b.N; i++ {
+		json.Marshal(val)
+	}
+}
+
+func BenchmarkMarshalJsonDynStruct(b *testing.B) {
+	b.ReportAllocs()
+	typ, _ := Define("T").
+		AddField("Field1", reflect.TypeOf("")).
+		AddField("Field2", reflect.TypeOf(int(0))).
+		AddField("Field3", reflect.TypeOf(float64(0))).Finish()
+	val := typ.New()
+	val.Set("Field1", "abcdefg")
+	val.Set("Field2", int(1234))
+	val.Set("Field3", float64(1234.5678))
+	for i := 0; i < b.N; i++ {
+		json.Marshal(val)
+	}
+}
+
+func BenchmarkAppendJsonDynStruct(b *testing.B) {
+	b.ReportAllocs()
+	typ, _ := Define("T").
+		AddField("Field1", reflect.TypeOf("")).
+		AddField("Field2", reflect.TypeOf(int(0))).
+		AddField("Field3", reflect.TypeOf(float64(0))).Finish()
+	val := typ.New()
+	val.Set("Field1", "abcdefg")
+	val.Set("Field2", int(1234))
+	val.Set("Field3", float64(1234.5678))
+	buf := make([]byte, 0, 128)
+	for i := 0; i < b.N; i++ {
+		buf, _ = val.AppendJSON(buf[:0])
+	}
+}
+
+func BenchmarkMarshalJsonMap(b *testing.B) {
+	b.ReportAllocs()
+	val := map[string]interface{}{
+		"Field1": "abcdefg",
+		"Field2": int(1234),
+		"Field3": float64(1234.5678),
+	}
+	for i := 0; i < b.N; i++ {
+		json.Marshal(val)
+	}
+}
+
+func BenchmarkUnmarshalJsonStruct(b *testing.B) {
+	b.ReportAllocs()
+	var val struct {
+		Field1 string
+		Field2 int
+		Field3 float64
+	}
+	for i := 0; i < b.N; i++ {
+		err := json.Unmarshal(data, &val)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+func BenchmarkUnmarshalJsonDynStruct(b *testing.B) {
+	b.ReportAllocs()
+	typ, _ := Define("T").
+		AddField("Field1", reflect.TypeOf("")).
+		AddField("Field2", reflect.TypeOf(int(0))).
+		AddField("Field3", reflect.TypeOf(float64(0))).
+		Finish()
+	for i := 0; i < b.N; i++ {
+		val := typ.New()
+		err := json.Unmarshal(data, &val)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalJsonDynStructExplicit(b *testing.B) {
+	b.ReportAllocs()
+	typ, _ := Define("T").
+		AddField("Field1", reflect.TypeOf("")).
+		AddField("Field2", reflect.TypeOf(int(0))).
+		AddField("Field3", reflect.TypeOf(float64(0))).
+		Finish()
+	for i := 0; i < b.N; i++ {
+		val := typ.New()
+		err := val.UnmarshalJSON(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalJsonMap(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var val map[string]interface{}
+		err := json.Unmarshal(data, &val)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalJsonRawMessageMap(b *testing.B) {
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		var val map[string]jsoniter.RawMessage
 		err := json.Unmarshal(data, &val)
@@ -557,3 +2295,91 @@ func BenchmarkUnmarshalJsonScan(b *testing.B) {
 		}
 	}
 }
+
+const wideFields = 200
+
+var wideData = func() []byte {
+	buf := bytes.NewBufferString("{")
+	for i := 0; i < wideFields; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		switch i % 3 {
+		case 0:
+			fmt.Fprintf(buf, `"Field%d":"value%d"`, i, i)
+		case 1:
+			fmt.Fprintf(buf, `"Field%d":%d`, i, i)
+		case 2:
+			fmt.Fprintf(buf, `"Field%d":%d.5`, i, i)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}()
+
+var wideTypes = []reflect.Type{reflect.TypeOf(""), reflect.TypeOf(int(0)), reflect.TypeOf(float64(0))}
+
+func BenchmarkUnmarshalJsonWideStruct(b *testing.B) {
+	b.ReportAllocs()
+	fields := make([]reflect.StructField, wideFields)
+	for i := range fields {
+		fields[i] = reflect.StructField{Name: "Field" + strconv.Itoa(i), Type: wideTypes[i%3]}
+	}
+	typ := reflect.StructOf(fields)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		val := reflect.New(typ).Interface()
+		err := stdjson.Unmarshal(wideData, val)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalJsonWideDynStruct(b *testing.B) {
+	b.ReportAllocs()
+	definer := Define("T")
+	for i := 0; i < wideFields; i++ {
+		definer.AddField("Field"+strconv.Itoa(i), wideTypes[i%3])
+	}
+	typ, _ := definer.Finish()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		val := typ.New()
+		err := val.UnmarshalJSON(wideData)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalJsonWideDynStructLazy(b *testing.B) {
+	b.ReportAllocs()
+	definer := Define("T")
+	for i := 0; i < wideFields; i++ {
+		definer.AddField("Field"+strconv.Itoa(i), wideTypes[i%3])
+	}
+	typ, _ := definer.WithDecodeOptions(DecodeOptions{Lazy: true}).Finish()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		val := typ.New()
+		err := val.UnmarshalJSON(wideData)
+		if err != nil {
+			panic(err)
+		}
+		val.Get("Field1")
+		val.Get("Field2")
+	}
+}
+
+func BenchmarkTokenizeWide(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tz := NewBytesTokenizer(wideData)
+		for {
+			if _, err := tz.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package dynstruct
+
+import (
+	"encoding"
+	stdjson "encoding/json"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	marshalerType       = reflect.TypeOf((*stdjson.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	unmarshalerType     = reflect.TypeOf((*stdjson.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// startDetectingCyclesAfter is the nesting depth of Values after which the
+// encoder starts tracking them to detect cycles, as encoding/json does.
+const startDetectingCyclesAfter = 1000
+
+type encodeState struct {
+	depth     int
+	visiting  map[uintptr]bool
+	keepHTML  bool                // disables escaping of <, > and &
+	keyNaming func(string) string // renames the keys of DynStruct fields
+	codec     Codec               // of the outermost Value
+}
+
+func (st *encodeState) key(dst []byte, f field) []byte {
+	if !st.renames(f) {
+		return append(dst, f.key...)
+	}
+	return append(appendString(dst, st.keyNaming(f.name), !st.keepHTML), ':')
+}
+
+// renames reports whether keyNaming applies to f, whose key set with Key wins.
+func (st *encodeState) renames(f field) bool {
+	return st.keyNaming != nil && !f.keyed
+}
+
+func (st *encodeState) marshal(v interface{}) ([]byte, error) {
+	return codecOf(st.codec).Marshal(v, !st.keepHTML)
+}
+
+func (st *encodeState) enter(v Value) error {
+	st.depth++
+	if st.depth <= startDetectingCyclesAfter {
+		return nil
+	}
+	id := reflect.ValueOf(v.value).Pointer()
+	if st.visiting[id] {
+		return makeCycleError(v.t)
+	}
+	if st.visiting == nil {
+		st.visiting = make(map[uintptr]bool)
+	}
+	st.visiting[id] = true
+	return nil
+}
+
+func (st *encodeState) leave(v Value) {
+	if st.depth > startDetectingCyclesAfter {
+		delete(st.visiting, reflect.ValueOf(v.value).Pointer())
+	}
+	st.depth--
+}
+
+var encodeStatePool = sync.Pool{New: func() interface{} { return new(encodeState) }}
+
+type encodeFunc func(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error)
+
+// AppendJSON appends the JSON encoding of v to dst, using the encoders
+// compiled for its DynStruct, and returns the extended buffer.
+func (v Value) AppendJSON(dst []byte) ([]byte, error) {
+	st := encodeStatePool.Get().(*encodeState)
+	defer encodeStatePool.Put(st)
+	*st = encodeState{codec: v.t.codec}
+	return v.appendJSON(dst, st)
+}
+
+func (v Value) appendJSON(dst []byte, st *encodeState) ([]byte, error) {
+	if err := st.enter(v); err != nil {
+		return dst, err
+	}
+	defer st.leave(v)
+
+	if v.t.hasEmbedded {
+		d, err := v.marshalFlattenedJSON(st)
+		return append(dst, d...), err
+	}
+	var err error
+	dst = append(dst, '{')
+	for i, field := range v.t.fields {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = st.key(dst, field)
+		fv := v.value[field.name]
+		if lf, ok := fv.(*lazyField); ok {
+			dst = append(dst, lf.data...)
+			continue
+		}
+		dst, err = field.encode(dst, field, fv, st)
+		if err != nil {
+			return dst, err
+		}
+	}
+	for i, f := range v.UnknownFields() {
+		if i > 0 || len(v.t.fields) > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '"')
+		dst = append(dst, f.Key...)
+		dst = append(dst, '"', ':')
+		dst = append(dst, f.Value...)
+	}
+	return append(dst, '}'), nil
+}
+
+// compileEncoders precomputes the quoted key and the encoder of every field.
+func (ds *DynStruct) compileEncoders() {
+	for i := range ds.fields {
+		f := &ds.fields[i]
+		f.key = append(appendString(nil, f.jsonKey, true), ':')
+		f.encode = encoderOf(*f)
+	}
+}
+
+func encoderOf(f field) encodeFunc {
+	switch {
+	case f.enum != nil:
+		return encodeEnum
+	case f.union != nil:
+		return encodeUnion
+	case f.ds != nil:
+		return encodeDyn
+	case f.t == timeType:
+		return encodeTime
+	case f.t == bigIntType || f.t == bigFloatType:
+		return encodeBig
+	case f.t.Implements(marshalerType) || f.t.Implements(textMarshalerType):
+		return encodeAny
+	}
+	switch f.t.Kind() {
+	case reflect.Bool:
+		return encodeBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return encodeUint
+	case reflect.Float32:
+		return encodeFloat32
+	case reflect.Float64:
+		return encodeFloat64
+	case reflect.String:
+		return encodeString
+	}
+	return encodeAny
+}
+
+func encodeAny(dst []byte, _ field, fv interface{}, st *encodeState) ([]byte, error) {
+	d, err := st.marshal(fv)
+	return append(dst, d...), err
+}
+
+func encodeEnum(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	d, err := f.enum.marshal(f.name, fv, st)
+	return append(dst, d...), err
+}
+
+func encodeUnion(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	d, err := f.union.marshal(fv, st)
+	return append(dst, d...), err
+}
+
+func encodeDyn(dst []byte, _ field, fv interface{}, st *encodeState) ([]byte, error) {
+	return appendDyn(dst, reflect.ValueOf(fv), st)
+}
+
+// encodeBig marshals big.Int and big.Float values through a pointer, as
+// their methods have pointer receivers.
+func encodeBig(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	switch n := fv.(type) {
+	case big.Int:
+		return encodeAny(dst, f, &n, st)
+	case big.Float:
+		return encodeAny(dst, f, &n, st)
+	}
+	return encodeAny(dst, f, fv, st)
+}
+
+func encodeBool(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	b, ok := fv.(bool)
+	if !ok {
+		rv := reflect.ValueOf(fv)
+		if rv.Kind() != reflect.Bool {
+			return encodeAny(dst, f, fv, st)
+		}
+		b = rv.Bool()
+	}
+	return strconv.AppendBool(dst, b), nil
+}
+
+func encodeInt(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	var n int64
+	switch i := fv.(type) {
+	case int:
+		n = int64(i)
+	case int8:
+		n = int64(i)
+	case int16:
+		n = int64(i)
+	case int32:
+		n = int64(i)
+	case int64:
+		n = i
+	default:
+		rv := reflect.ValueOf(fv)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = rv.Int()
+		default:
+			// nil or of another type, as set through the unchecked setters
+			return encodeAny(dst, f, fv, st)
+		}
+	}
+	return strconv.AppendInt(dst, n, 10), nil
+}
+
+func encodeUint(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	var n uint64
+	switch i := fv.(type) {
+	case uint:
+		n = uint64(i)
+	case uint8:
+		n = uint64(i)
+	case uint16:
+		n = uint64(i)
+	case uint32:
+		n = uint64(i)
+	case uint64:
+		n = i
+	default:
+		rv := reflect.ValueOf(fv)
+		switch rv.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			n = rv.Uint()
+		default:
+			return encodeAny(dst, f, fv, st)
+		}
+	}
+	return strconv.AppendUint(dst, n, 10), nil
+}
+
+func encodeFloat32(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	x, ok := fv.(float32)
+	if !ok {
+		rv := reflect.ValueOf(fv)
+		if rv.Kind() != reflect.Float32 {
+			return encodeAny(dst, f, fv, st)
+		}
+		x = float32(rv.Float())
+	}
+	return appendFloat(dst, float64(x), 32)
+}
+
+func encodeFloat64(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	x, ok := fv.(float64)
+	if !ok {
+		rv := reflect.ValueOf(fv)
+		if rv.Kind() != reflect.Float64 {
+			return encodeAny(dst, f, fv, st)
+		}
+		x = rv.Float()
+	}
+	return appendFloat(dst, x, 64)
+}
+
+func encodeString(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	s, ok := fv.(string)
+	if !ok {
+		rv := reflect.ValueOf(fv)
+		if rv.Kind() != reflect.String {
+			return encodeAny(dst, f, fv, st)
+		}
+		s = rv.String()
+	}
+	return appendString(dst, s, !st.keepHTML), nil
+}
+
+func encodeTime(dst []byte, f field, fv interface{}, st *encodeState) ([]byte, error) {
+	t, ok := fv.(time.Time)
+	if y := t.Year(); !ok || y < 0 || y >= 10000 {
+		return encodeAny(dst, f, fv, st)
+	}
+	dst = append(dst, '"')
+	dst = t.AppendFormat(dst, time.RFC3339Nano)
+	return append(dst, '"'), nil
+}
+
+// appendFloat formats f like encoding/json does.
+func appendFloat(dst []byte, f float64, bits int) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return dst, makeUnsupportedFloatError(f)
+	}
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, bits)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
+
+const hex = "0123456789abcdef"
+
+// appendString quotes s like encoding/json does.
+func appendString(dst []byte, s string, escapeHTML bool) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= ' ' && b != '"' && b != '\\' && (!escapeHTML || b != '<' && b != '>' && b != '&') {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hex[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+// appendDyn encodes the Values held through pointers, slices and maps by rv,
+// sharing st with them.
+func appendDyn(dst []byte, rv reflect.Value, st *encodeState) ([]byte, error) {
+	// nil, or a Value of no DynStruct, as set through the unchecked setters
+	if !rv.IsValid() || rv.Type() == valueType && rv.Interface().(Value).t == nil {
+		return append(dst, "null"...), nil
+	}
+	var err error
+	switch rv.Kind() {
+	case reflect.Struct:
+		return rv.Interface().(Value).appendJSON(dst, st)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return append(dst, "null"...), nil
+		}
+		return appendDyn(dst, rv.Elem(), st)
+	case reflect.Slice:
+		if rv.IsNil() {
+			return append(dst, "null"...), nil
+		}
+		dst = append(dst, '[')
+		for i := 0; i < rv.Len(); i++ {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			if dst, err = appendDyn(dst, rv.Index(i), st); err != nil {
+				return dst, err
+			}
+		}
+		return append(dst, ']'), nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return append(dst, "null"...), nil
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		dst = append(dst, '{')
+		for i, k := range keys {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = append(appendString(dst, k.String(), !st.keepHTML), ':')
+			if dst, err = appendDyn(dst, rv.MapIndex(k), st); err != nil {
+				return dst, err
+			}
+		}
+		return append(dst, '}'), nil
+	}
+	d, err := st.marshal(rv.Interface())
+	return append(dst, d...), err
+}
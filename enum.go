@@ -0,0 +1,140 @@
+package dynstruct
+
+import (
+	"reflect"
+	"strconv"
+)
+
+var stringType = reflect.TypeOf("")
+
+type enumType struct {
+	names  []string
+	codes  []int64
+	byName map[string]int
+	byCode map[int64]int
+	asCode bool
+	err    error
+}
+
+// Enum returns a field template restricted to the named members. Values of
+// the field are member names, the first member being the zero value, and the
+// code of each member defaults to its index.
+func Enum(names ...string) enumType {
+	if len(names) == 0 {
+		return enumType{err: makeInvalidNameError("enum member", "")}
+	}
+	e := enumType{
+		names:  names,
+		codes:  make([]int64, len(names)),
+		byName: make(map[string]int, len(names)),
+	}
+	for i, name := range names {
+		if name == "" {
+			return enumType{err: makeInvalidNameError("enum member", name)}
+		}
+		if _, ok := e.byName[name]; ok {
+			return enumType{err: makeRepeatedNameError("enum member", name)}
+		}
+		e.byName[name] = i
+		e.codes[i] = int64(i)
+	}
+	return e.indexCodes()
+}
+
+// WithCodes assigns integer codes to the members in declaration order.
+func (e enumType) WithCodes(codes ...int64) enumType {
+	if e.err != nil {
+		return e
+	}
+	if len(codes) != len(e.names) {
+		e.err = makeInvalidEnumCodesError(len(e.names), len(codes))
+		return e
+	}
+	e.codes = codes
+	return e.indexCodes()
+}
+
+// EncodeCodes makes MarshalJSON render members by code instead of by name.
+func (e enumType) EncodeCodes() enumType {
+	e.asCode = true
+	return e
+}
+
+func (e enumType) indexCodes() enumType {
+	e.byCode = make(map[int64]int, len(e.codes))
+	for i, code := range e.codes {
+		if _, ok := e.byCode[code]; ok {
+			e.err = makeRepeatedEnumCodeError(code)
+			return e
+		}
+		e.byCode[code] = i
+	}
+	return e
+}
+
+// member returns the name of the member val refers to by name or by code.
+func (e *enumType) member(val interface{}) (string, bool) {
+	if name, ok := val.(string); ok {
+		_, ok := e.byName[name]
+		return name, ok
+	}
+	rv := reflect.ValueOf(val)
+	var code int64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		code = rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > 1<<63-1 {
+			return "", false
+		}
+		code = int64(rv.Uint())
+	default:
+		return "", false
+	}
+	i, ok := e.byCode[code]
+	if !ok {
+		return "", false
+	}
+	return e.names[i], true
+}
+
+func (e *enumType) zero() string {
+	return e.names[0]
+}
+
+func (e *enumType) marshal(field string, val interface{}, st *encodeState) ([]byte, error) {
+	name, _ := val.(string)
+	i, ok := e.byName[name]
+	if !ok {
+		return nil, makeUnknownMemberError(field, name)
+	}
+	if e.asCode {
+		return strconv.AppendInt(nil, e.codes[i], 10), nil
+	}
+	return appendString(nil, name, !st.keepHTML), nil
+}
+
+func (e *enumType) unmarshal(field string, data []byte, opts *DecodeOptions) (interface{}, error) {
+	if string(data) == "null" {
+		return e.zero(), nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var name string
+		if err := codecOf(opts.codec).Unmarshal(data, &name, *opts); err != nil {
+			return nil, err
+		}
+		if _, ok := e.byName[name]; !ok {
+			return nil, makeUnknownMemberError(field, name)
+		}
+		return name, nil
+	}
+	code, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return nil, makeUnknownMemberError(field, string(data))
+	}
+	i, ok := e.byCode[code]
+	if !ok {
+		return nil, makeUnknownMemberError(field, string(data))
+	}
+	return e.names[i], nil
+}
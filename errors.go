@@ -3,6 +3,8 @@ package dynstruct
 import (
 	"fmt"
 	"reflect"
+
+	"gopkg.in/yaml.v3"
 )
 
 type unmatchedTypeError struct {
@@ -97,3 +99,360 @@ func makeNilTypeError(field string) error {
 func (e nilFieldTypeError) Error() string {
 	return fmt.Sprintf("type of field %#v is nil", e.field)
 }
+
+type unfinishedTypeError struct {
+	field string
+}
+
+func makeUnfinishedTypeError(field string) error {
+	return unfinishedTypeError{field: field}
+}
+
+func (e unfinishedTypeError) Error() string {
+	if e.field == "" {
+		return "embedded type is not finished"
+	}
+	return fmt.Sprintf("type of field %#v is not finished", e.field)
+}
+
+type invalidEmbedError struct {
+	t reflect.Type
+}
+
+func makeInvalidEmbedError(t reflect.Type) error {
+	return invalidEmbedError{t: t}
+}
+
+func (e invalidEmbedError) Error() string {
+	return fmt.Sprintf("invalid embedded type: %v", e.t)
+}
+
+type invalidMapKeyError struct {
+	t reflect.Type
+}
+
+func makeInvalidMapKeyError(t reflect.Type) error {
+	return invalidMapKeyError{t: t}
+}
+
+func (e invalidMapKeyError) Error() string {
+	return fmt.Sprintf("invalid map key type: %v", e.t)
+}
+
+type cycleError struct {
+	t string
+}
+
+func makeCycleError(t *DynStruct) error {
+	return cycleError{t: t.String()}
+}
+
+func (e cycleError) Error() string {
+	return fmt.Sprintf("encountered a cycle via value of type %#v", e.t)
+}
+
+type invalidVariantError struct {
+	variant string
+}
+
+func makeInvalidVariantError(variant string) error {
+	return invalidVariantError{variant: variant}
+}
+
+func (e invalidVariantError) Error() string {
+	return fmt.Sprintf("invalid union variant: %#v", e.variant)
+}
+
+type unmatchedVariantError struct {
+	field string
+	got   string
+}
+
+func makeUnmatchedVariantError(field, got string) error {
+	return unmatchedVariantError{field: field, got: got}
+}
+
+func (e unmatchedVariantError) Error() string {
+	return fmt.Sprintf("union field %#v has no variant matching %#v", e.field, e.got)
+}
+
+type notUnionError struct {
+	t     string
+	field string
+}
+
+func makeNotUnionError(t *DynStruct, field string) error {
+	return notUnionError{t: t.String(), field: field}
+}
+
+func (e notUnionError) Error() string {
+	return fmt.Sprintf("field %#v of type %#v is not a union", e.field, e.t)
+}
+
+type invalidEnumCodesError struct {
+	members int
+	codes   int
+}
+
+func makeInvalidEnumCodesError(members, codes int) error {
+	return invalidEnumCodesError{members: members, codes: codes}
+}
+
+func (e invalidEnumCodesError) Error() string {
+	return fmt.Sprintf("enum of %d members given %d codes", e.members, e.codes)
+}
+
+type repeatedEnumCodeError struct {
+	code int64
+}
+
+func makeRepeatedEnumCodeError(code int64) error {
+	return repeatedEnumCodeError{code: code}
+}
+
+func (e repeatedEnumCodeError) Error() string {
+	return fmt.Sprintf("repeated enum code: %d", e.code)
+}
+
+type unknownMemberError struct {
+	field  string
+	member string
+}
+
+func makeUnknownMemberError(field, member string) error {
+	return unknownMemberError{field: field, member: member}
+}
+
+func (e unknownMemberError) Error() string {
+	return fmt.Sprintf("enum field %#v has no member %#v", e.field, e.member)
+}
+
+type invalidSampleError struct {
+	got string
+}
+
+func makeInvalidSampleError(got string) error {
+	return invalidSampleError{got: got}
+}
+
+func (e invalidSampleError) Error() string {
+	return fmt.Sprintf("sample must be a JSON object, got %s", e.got)
+}
+
+type unsupportedFloatError struct {
+	f float64
+}
+
+func makeUnsupportedFloatError(f float64) error {
+	return unsupportedFloatError{f: f}
+}
+
+func (e unsupportedFloatError) Error() string {
+	return fmt.Sprintf("unsupported float value: %v", e.f)
+}
+
+type unopenedArrayError struct{}
+
+func makeUnopenedArrayError() error {
+	return unopenedArrayError{}
+}
+
+func (e unopenedArrayError) Error() string {
+	return "Encoder.EndArray() called without Encoder.BeginArray()"
+}
+
+// DecodeError is returned by Decoder and ValueSlice for a record, or an
+// element, that fails to decode: Index counts the records from 0 and Offset
+// is where the record starts in the input.
+type DecodeError struct {
+	Index  int
+	Offset int64
+	Err    error
+}
+
+func makeDecodeError(index int, offset int64, err error) error {
+	return DecodeError{Index: index, Offset: offset, Err: err}
+}
+
+func (e DecodeError) Error() string {
+	return fmt.Sprintf("record %d at offset %d: %s", e.Index, e.Offset, e.Err)
+}
+
+func (e DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownKeyError is returned under DisallowUnknownFields for a key Type
+// has no field for.
+type UnknownKeyError struct {
+	Type string
+	Key  string
+}
+
+func makeUnknownKeyError(t *DynStruct, key string) error {
+	return UnknownKeyError{Type: t.String(), Key: key}
+}
+
+func (e UnknownKeyError) Error() string {
+	return fmt.Sprintf("type %#v has no field for key %#v", e.Type, e.Key)
+}
+
+// DuplicateKeyError is returned under RejectDuplicateKeys for a key given
+// twice, or for two keys matching the same field.
+type DuplicateKeyError struct {
+	Type string
+	Key  string
+}
+
+func makeDuplicateKeyError(t *DynStruct, key string) error {
+	return DuplicateKeyError{Type: t.String(), Key: key}
+}
+
+func (e DuplicateKeyError) Error() string {
+	return fmt.Sprintf("type %#v got duplicate key %#v", e.Type, e.Key)
+}
+
+// MissingKeyError is returned for the key of a required field missing from
+// the input, or of any field under RequireAllFields.
+type MissingKeyError struct {
+	Type string
+	Key  string
+}
+
+func makeMissingKeyError(t *DynStruct, key string) error {
+	return MissingKeyError{Type: t.String(), Key: key}
+}
+
+func (e MissingKeyError) Error() string {
+	return fmt.Sprintf("type %#v missing required key %#v", e.Type, e.Key)
+}
+
+type notIntegerError struct{}
+
+func makeNotIntegerError() error {
+	return notIntegerError{}
+}
+
+func (e notIntegerError) Error() string {
+	return "not an integer"
+}
+
+type fieldDecodeError struct {
+	field string
+	t     string
+	data  string
+	err   error
+}
+
+// maxErrorData bounds the JSON quoted by decoding errors.
+const maxErrorData = 32
+
+func makeFieldDecodeError(field string, t reflect.Type, data []byte, err error) error {
+	if len(data) > maxErrorData {
+		data = append(data[:maxErrorData:maxErrorData], "..."...)
+	}
+	return fieldDecodeError{field: field, t: t.String(), data: string(data), err: err}
+}
+
+func (e fieldDecodeError) Error() string {
+	return fmt.Sprintf("field %#v cannot decode %s into %#v: %s", e.field, e.data, e.t, e.err)
+}
+
+func (e fieldDecodeError) Unwrap() error {
+	return e.err
+}
+
+type invalidPathError struct {
+	path string
+}
+
+func makeInvalidPathError(path string) error {
+	return invalidPathError{path: path}
+}
+
+func (e invalidPathError) Error() string {
+	return fmt.Sprintf("invalid path %#v", e.path)
+}
+
+type pathNotFoundError struct {
+	path string
+}
+
+func makePathNotFoundError(path string) error {
+	return pathNotFoundError{path: path}
+}
+
+func (e pathNotFoundError) Error() string {
+	return fmt.Sprintf("no value at path %#v", e.path)
+}
+
+type unmatchedElemError struct {
+	t   string
+	got string
+}
+
+func makeUnmatchedElemError(t, got *DynStruct) error {
+	var e unmatchedElemError
+	if t != nil {
+		e.t = t.String()
+	}
+	if got != nil {
+		e.got = got.String()
+	}
+	return e
+}
+
+func (e unmatchedElemError) Error() string {
+	return fmt.Sprintf("slice of %#v cannot hold a Value of %#v", e.t, e.got)
+}
+
+type yamlTypeError struct {
+	line int
+	tag  string
+	t    string
+}
+
+func makeYAMLTypeError(node *yaml.Node, t string) error {
+	return yamlTypeError{line: node.Line, tag: node.ShortTag(), t: t}
+}
+
+func (e yamlTypeError) Error() string {
+	return fmt.Sprintf("line %d: cannot decode %s into %#v", e.line, e.tag, e.t)
+}
+
+type yamlFieldError struct {
+	line  int
+	field string
+	tag   string
+	t     string
+	err   error
+}
+
+func makeYAMLFieldError(node *yaml.Node, field string, t reflect.Type, err error) error {
+	return yamlFieldError{line: node.Line, field: field, tag: node.ShortTag(), t: t.String(), err: err}
+}
+
+func (e yamlFieldError) Error() string {
+	return fmt.Sprintf("line %d: field %#v cannot decode %s into %#v", e.line, e.field, e.tag, e.t)
+}
+
+func (e yamlFieldError) Unwrap() error {
+	return e.err
+}
+
+type yamlError struct {
+	line int
+	err  error
+}
+
+func makeYAMLError(node *yaml.Node, err error) error {
+	return yamlError{line: node.Line, err: err}
+}
+
+func (e yamlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.err)
+}
+
+func (e yamlError) Unwrap() error {
+	return e.err
+}
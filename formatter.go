@@ -3,6 +3,8 @@ package dynstruct
 import (
 	"fmt"
 	"io"
+	"reflect"
+	"sort"
 )
 
 var _ fmt.Formatter = Value{}
@@ -14,27 +16,35 @@ func (v Value) Format(f fmt.State, c rune) {
 	}
 	switch {
 	case f.Flag('+'):
-		v.formatPlugString(f)
+		v.formatPlugString(f, nil)
 	case f.Flag('#'):
-		v.formatGoString(f)
+		v.formatGoString(f, nil)
 	default:
-		v.formatString(f)
+		v.formatString(f, nil)
 	}
 }
 
-func (v Value) formatString(w io.Writer) {
+func (v Value) formatString(w io.Writer, visiting map[uintptr]bool) {
+	visiting = v.enter(visiting)
+	defer v.leave(visiting)
 	w.Write([]byte{'{'})
 	for i, field := range v.t.fields {
 		if i > 0 {
 			w.Write([]byte{' '})
 		}
-		fv := v.value[field.name]
+		fv := v.mustLoad(field.name)
+		if field.ds != nil {
+			formatDyn(w, 'v', reflect.ValueOf(fv), field.ds, visiting)
+			continue
+		}
 		fmt.Fprint(w, fv)
 	}
 	w.Write([]byte{'}'})
 }
 
-func (v Value) formatPlugString(w io.Writer) {
+func (v Value) formatPlugString(w io.Writer, visiting map[uintptr]bool) {
+	visiting = v.enter(visiting)
+	defer v.leave(visiting)
 	w.Write([]byte{'{'})
 	for i, field := range v.t.fields {
 		if i > 0 {
@@ -42,13 +52,19 @@ func (v Value) formatPlugString(w io.Writer) {
 		}
 		fmt.Fprint(w, field.name)
 		w.Write([]byte{':'})
-		fv := v.value[field.name]
+		fv := v.mustLoad(field.name)
+		if field.ds != nil {
+			formatDyn(w, '+', reflect.ValueOf(fv), field.ds, visiting)
+			continue
+		}
 		fmt.Fprintf(w, "%+v", fv)
 	}
 	w.Write([]byte{'}'})
 }
 
-func (v Value) formatGoString(w io.Writer) {
+func (v Value) formatGoString(w io.Writer, visiting map[uintptr]bool) {
+	visiting = v.enter(visiting)
+	defer v.leave(visiting)
 	w.Write([]byte(v.t.fullName))
 	w.Write([]byte{'{'})
 	for i, field := range v.t.fields {
@@ -57,7 +73,11 @@ func (v Value) formatGoString(w io.Writer) {
 		}
 		fmt.Fprint(w, field.name)
 		w.Write([]byte{':'})
-		fv := v.value[field.name]
+		fv := v.mustLoad(field.name)
+		if field.ds != nil {
+			formatDyn(w, '#', reflect.ValueOf(fv), field.ds, visiting)
+			continue
+		}
 		fmt.Fprintf(w, "%#v", fv)
 	}
 	w.Write([]byte{'}'})
@@ -70,7 +90,7 @@ func (v Value) formatUnknown(f fmt.State, c rune) {
 		if i > 0 {
 			f.Write([]byte{' '})
 		}
-		fv := v.value[field.name]
+		fv := v.mustLoad(field.name)
 		if i, ok := fv.(fmt.Formatter); ok {
 			i.Format(f, c)
 		} else {
@@ -79,3 +99,134 @@ func (v Value) formatUnknown(f fmt.State, c rune) {
 	}
 	f.Write([]byte{'}'})
 }
+
+func (v Value) enter(visiting map[uintptr]bool) map[uintptr]bool {
+	if visiting == nil {
+		visiting = make(map[uintptr]bool)
+	}
+	visiting[reflect.ValueOf(v.value).Pointer()] = true
+	return visiting
+}
+
+func (v Value) leave(visiting map[uintptr]bool) {
+	delete(visiting, reflect.ValueOf(v.value).Pointer())
+}
+
+// formatDyn formats the Values held by rv the way fmt formats nested structs:
+// pointers are printed as addresses, which also breaks cycles through them.
+func formatDyn(w io.Writer, verb byte, rv reflect.Value, ds *DynStruct, visiting map[uintptr]bool) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		val := rv.Interface().(Value)
+		if visiting[reflect.ValueOf(val.value).Pointer()] {
+			io.WriteString(w, "<cycle>")
+			return
+		}
+		switch verb {
+		case '+':
+			val.formatPlugString(w, visiting)
+		case '#':
+			val.formatGoString(w, visiting)
+		default:
+			val.formatString(w, visiting)
+		}
+	case reflect.Ptr:
+		if verb == '#' {
+			fmt.Fprintf(w, "(%s)(", typeString(rv.Type(), ds))
+			if rv.IsNil() {
+				io.WriteString(w, "nil")
+			} else {
+				fmt.Fprintf(w, "%#x", rv.Pointer())
+			}
+			io.WriteString(w, ")")
+			return
+		}
+		if rv.IsNil() {
+			io.WriteString(w, "<nil>")
+			return
+		}
+		fmt.Fprintf(w, "%#x", rv.Pointer())
+	case reflect.Slice:
+		if verb == '#' {
+			io.WriteString(w, typeString(rv.Type(), ds))
+			if rv.IsNil() {
+				io.WriteString(w, "(nil)")
+				return
+			}
+			io.WriteString(w, "{")
+		} else {
+			io.WriteString(w, "[")
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if i > 0 {
+				if verb == '#' {
+					io.WriteString(w, ", ")
+				} else {
+					io.WriteString(w, " ")
+				}
+			}
+			formatDyn(w, verb, rv.Index(i), ds, visiting)
+		}
+		if verb == '#' {
+			io.WriteString(w, "}")
+		} else {
+			io.WriteString(w, "]")
+		}
+	case reflect.Map:
+		if verb == '#' {
+			io.WriteString(w, typeString(rv.Type(), ds))
+			if rv.IsNil() {
+				io.WriteString(w, "(nil)")
+				return
+			}
+			io.WriteString(w, "{")
+		} else {
+			io.WriteString(w, "map[")
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for i, k := range keys {
+			if i > 0 {
+				if verb == '#' {
+					io.WriteString(w, ", ")
+				} else {
+					io.WriteString(w, " ")
+				}
+			}
+			if verb == '#' {
+				fmt.Fprintf(w, "%#v:", k.Interface())
+			} else {
+				fmt.Fprintf(w, "%v:", k.Interface())
+			}
+			formatDyn(w, verb, rv.MapIndex(k), ds, visiting)
+		}
+		if verb == '#' {
+			io.WriteString(w, "}")
+		} else {
+			io.WriteString(w, "]")
+		}
+	default:
+		switch verb {
+		case '+':
+			fmt.Fprintf(w, "%+v", rv.Interface())
+		case '#':
+			fmt.Fprintf(w, "%#v", rv.Interface())
+		default:
+			fmt.Fprint(w, rv.Interface())
+		}
+	}
+}
+
+func typeString(t reflect.Type, ds *DynStruct) string {
+	switch {
+	case t == valueType:
+		return ds.fullName
+	case t.Kind() == reflect.Ptr:
+		return "*" + typeString(t.Elem(), ds)
+	case t.Kind() == reflect.Slice:
+		return "[]" + typeString(t.Elem(), ds)
+	case t.Kind() == reflect.Map:
+		return "map[" + t.Key().String() + "]" + typeString(t.Elem(), ds)
+	}
+	return t.String()
+}
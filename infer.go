@@ -0,0 +1,310 @@
+package dynstruct
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/nextzhou/dynstruct/internal/jsonscan"
+)
+
+type inferKind uint8
+
+const (
+	inferNone inferKind = iota // only null seen
+	inferBool
+	inferInt
+	inferFloat
+	inferString
+	inferObject
+	inferArray
+	inferConflict
+)
+
+var inferKindNames = []string{"null", "bool", "int", "float64", "string", "object", "array", "conflict"}
+
+type inferredType struct {
+	kind     inferKind
+	nullable bool
+	object   *inferredObject
+	elem     *inferredType
+	kinds    []inferKind // every kind seen, for reporting conflicts
+}
+
+type inferredObject struct {
+	keys   []string
+	fields map[string]*inferredField
+	count  int
+}
+
+type inferredField struct {
+	t     *inferredType
+	count int
+}
+
+// Conflict describes a path at which the samples hold incompatible types;
+// the inferred field is typed interface{}.
+type Conflict struct {
+	Path  string
+	Types []string
+}
+
+type inferer struct {
+	pkg, name string
+	root      inferredObject
+	conflicts []Conflict
+	err       error
+}
+
+// Infer starts inferring a DynStruct named name from sample JSON objects.
+// Fields missing from some samples or sometimes null become pointers, ints
+// widen to float64 and nested objects become nested DynStructs.
+func Infer(name string) *inferer {
+	return &inferer{
+		pkg:  getPkgName(),
+		name: name,
+		root: inferredObject{fields: make(map[string]*inferredField)},
+	}
+}
+
+func (in *inferer) Add(docs ...[]byte) *inferer {
+	for _, doc := range docs {
+		if in.err != nil {
+			return in
+		}
+		if shapeOf(doc) != shapeObject {
+			in.err = makeInvalidSampleError(shapeOf(doc).String())
+			return in
+		}
+		in.err = in.root.merge(doc)
+	}
+	return in
+}
+
+// AddNDJSON adds every JSON object of r, separated by newlines or any other
+// whitespace.
+func (in *inferer) AddNDJSON(r io.Reader) *inferer {
+	dec := stdjson.NewDecoder(r)
+	for in.err == nil && dec.More() {
+		var doc stdjson.RawMessage
+		if err := dec.Decode(&doc); err != nil {
+			in.err = err
+			break
+		}
+		in.Add(doc)
+	}
+	return in
+}
+
+func (in *inferer) Finish() (DynStruct, error) {
+	if in.err != nil {
+		return DynStruct{}, in.err
+	}
+	if in.root.count == 0 {
+		return DynStruct{}, makeInvalidSampleError("nothing")
+	}
+	in.conflicts = nil
+	return in.build(in.name, "", &in.root)
+}
+
+// Conflicts returns the conflicts found by the last call to Finish.
+func (in *inferer) Conflicts() []Conflict {
+	return in.conflicts
+}
+
+func (o *inferredObject) merge(data []byte) error {
+	kvs, err := jsonscan.Scan(data)
+	if err != nil {
+		return err
+	}
+	o.count++
+	for _, kv := range kvs {
+		f, ok := o.fields[kv.Key]
+		if !ok {
+			f = &inferredField{t: &inferredType{}}
+			o.fields[kv.Key] = f
+			o.keys = append(o.keys, kv.Key)
+		}
+		f.count++
+		if err := f.t.merge(kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *inferredType) merge(data []byte) error {
+	var kind inferKind
+	switch shapeOf(data) {
+	case shapeNull:
+		t.nullable = true
+		return nil
+	case shapeBool:
+		kind = inferBool
+	case shapeString:
+		kind = inferString
+	case shapeNumber:
+		kind = inferInt
+		if bytes.ContainsAny(data, ".eE") {
+			kind = inferFloat
+		}
+	case shapeObject:
+		kind = inferObject
+	case shapeArray:
+		kind = inferArray
+	}
+	t.see(kind)
+
+	switch {
+	case t.kind == inferNone || t.kind == kind:
+		t.kind = kind
+	case t.kind == inferInt && kind == inferFloat, t.kind == inferFloat && kind == inferInt:
+		t.kind = inferFloat
+	default:
+		t.kind = inferConflict
+	}
+
+	switch kind {
+	case inferObject:
+		if t.object == nil {
+			t.object = &inferredObject{fields: make(map[string]*inferredField)}
+		}
+		return t.object.merge(data)
+	case inferArray:
+		var items []stdjson.RawMessage
+		if err := stdjson.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if t.elem == nil {
+				t.elem = &inferredType{}
+			}
+			if err := t.elem.merge(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *inferredType) see(kind inferKind) {
+	for _, k := range t.kinds {
+		if k == kind {
+			return
+		}
+	}
+	t.kinds = append(t.kinds, kind)
+}
+
+func (in *inferer) build(name, path string, o *inferredObject) (DynStruct, error) {
+	d := define(in.pkg, name)
+	taken := make(map[string]bool, len(o.keys))
+	for _, key := range o.keys {
+		if isValidIdent(key) {
+			taken[key] = true
+		}
+	}
+	for _, key := range o.keys {
+		f := o.fields[key]
+		fieldName, opts := key, []FieldOption(nil)
+		if !isValidIdent(key) {
+			fieldName = identName(key, taken)
+			opts = append(opts, Key(key))
+		}
+		template, err := in.template(fieldName, joinPath(path, key), f.t, f.count < o.count)
+		if err != nil {
+			return DynStruct{}, err
+		}
+		d.AddField(fieldName, template, opts...)
+	}
+	return d.Finish()
+}
+
+func (in *inferer) template(key, path string, t *inferredType, optional bool) (interface{}, error) {
+	optional = optional || t.nullable
+	var elem interface{}
+	switch t.kind {
+	case inferBool:
+		elem = reflect.TypeOf(false)
+	case inferInt:
+		elem = reflect.TypeOf(int(0))
+	case inferFloat:
+		elem = reflect.TypeOf(float64(0))
+	case inferString:
+		elem = stringType
+	case inferObject:
+		ds, err := in.build(exportName(key), path, t.object)
+		if err != nil {
+			return nil, err
+		}
+		elem = ds
+	case inferArray:
+		if t.elem == nil {
+			return reflect.TypeOf([]interface{}(nil)), nil
+		}
+		item, err := in.template(key, path+"[]", t.elem, false)
+		if err != nil {
+			return nil, err
+		}
+		return SliceOf(item), nil
+	case inferConflict:
+		types := make([]string, len(t.kinds))
+		for i, k := range t.kinds {
+			types[i] = inferKindNames[k]
+		}
+		in.conflicts = append(in.conflicts, Conflict{Path: path, Types: types})
+		return interfaceType, nil
+	default:
+		return interfaceType, nil
+	}
+	if optional {
+		return PtrTo(elem), nil
+	}
+	return elem, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// identName derives a field name not taken yet from a key that is not an
+// identifier: runs of other characters are dropped, camel-casing the words
+// they separate, and a number is appended on collision.
+func identName(key string, taken map[string]bool) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range key {
+		if !isValidIdentChar(c) {
+			upper = b.Len() > 0
+			continue
+		}
+		if b.Len() == 0 && isNumber(c) {
+			b.WriteByte('_')
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+			upper = false
+		}
+		b.WriteRune(c)
+	}
+	if b.Len() == 0 {
+		b.WriteByte('_')
+	}
+	name := b.String()
+	for i := 2; taken[name]; i++ {
+		name = b.String() + strconv.Itoa(i)
+	}
+	taken[name] = true
+	return name
+}
+
+func exportName(key string) string {
+	return strings.ToUpper(key[:1]) + key[1:]
+}
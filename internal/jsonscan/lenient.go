@@ -0,0 +1,218 @@
+package jsonscan
+
+import (
+	"bytes"
+	"sort"
+)
+
+// shift maps the offsets of a normalized document from out onwards back to
+// the document it was normalized from, starting at in.
+type shift struct {
+	in, out int
+}
+
+type normalizer struct {
+	data   []byte
+	out    []byte
+	shifts []shift
+	stack  []byte // the brackets of the arrays and objects open
+	// whether the next significant character starts a key
+	expectKey bool
+	// index in out of a comma a closing bracket would make trailing
+	comma int
+	// whether a value or member follows the last opening bracket or comma,
+	// which only then may be trailing
+	element bool
+}
+
+// Normalize turns lenient JSON into strict JSON: comments and trailing commas
+// are blanked out, identifier keys are quoted and single-quoted strings are
+// double-quoted. Other syntax errors are reported as Scan reports them, at
+// their offset in data, as are the limits exceeded.
+func Normalize(data []byte, limits Limits) ([]byte, error) {
+	if limits.MaxBytes > 0 && len(data) > limits.MaxBytes {
+		return nil, &LimitError{Err: ErrMaxBytes, Max: limits.MaxBytes, Offset: limits.MaxBytes}
+	}
+	n := &normalizer{data: data, out: make([]byte, 0, len(data)+len(data)/8), comma: -1}
+	if err := n.normalize(); err != nil {
+		return nil, err
+	}
+	// quoting makes the document longer than data
+	limits.MaxBytes = 0
+	if _, err := ScanLimits(n.out, limits); err != nil {
+		switch e := err.(type) {
+		case *SyntaxError:
+			return nil, n.mapError(e)
+		case *LimitError:
+			e.Offset = n.inputOffset(e.Offset)
+		}
+		return nil, err
+	}
+	return n.out, nil
+}
+
+func (n *normalizer) normalize() error {
+	data := n.data
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			n.out = append(n.out, c)
+			i++
+			continue
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			end := bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data) - i
+			}
+			n.blank(data[i : i+end])
+			i += end
+			continue
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return n.errorAt(len(data))
+			}
+			n.blank(data[i : i+end+4])
+			i += end + 4
+			continue
+		}
+
+		if n.comma >= 0 && (c == '}' || c == ']') {
+			n.out[n.comma] = ' '
+		}
+		n.comma = -1
+		key := n.expectKey
+		n.expectKey = false
+		element := n.element
+		n.element = true
+		switch {
+		case c == '{' || c == '[':
+			n.stack = append(n.stack, c)
+			n.expectKey = c == '{'
+			n.element = false
+			n.out = append(n.out, c)
+			i++
+		case c == '}' || c == ']':
+			if len(n.stack) > 0 {
+				n.stack = n.stack[:len(n.stack)-1]
+			}
+			n.out = append(n.out, c)
+			i++
+		case c == ',':
+			// a comma following no element is left for Scan to report
+			if element {
+				n.comma = len(n.out)
+			}
+			n.expectKey = len(n.stack) > 0 && n.stack[len(n.stack)-1] == '{'
+			n.element = false
+			n.out = append(n.out, c)
+			i++
+		case c == '"':
+			end := stringEnd(data, i, '"')
+			if end < 0 {
+				return n.errorAt(len(data))
+			}
+			n.out = append(n.out, data[i:end]...)
+			i = end
+		case c == '\'':
+			end := stringEnd(data, i, '\'')
+			if end < 0 {
+				return n.errorAt(len(data))
+			}
+			n.quote(data[i+1:end-1], i)
+			i = end
+		case key && isIdentStart(c):
+			end := i + 1
+			for end < len(data) && isIdentPart(data[end]) {
+				end++
+			}
+			n.out = append(n.out, '"')
+			n.out = append(n.out, data[i:end]...)
+			n.out = append(n.out, '"')
+			i = end
+			n.shifts = append(n.shifts, shift{in: i, out: len(n.out)})
+		default:
+			n.out = append(n.out, c)
+			i++
+		}
+	}
+	return nil
+}
+
+// blank replaces a comment with spaces, keeping its newlines so that lines
+// and columns are left alone.
+func (n *normalizer) blank(comment []byte) {
+	for _, c := range comment {
+		if c != '\n' {
+			c = ' '
+		}
+		n.out = append(n.out, c)
+	}
+}
+
+// quote appends the body of the single-quoted string starting at offset in
+// as a double-quoted one.
+func (n *normalizer) quote(body []byte, in int) {
+	n.out = append(n.out, '"')
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '"':
+			n.out = append(n.out, '\\', '"')
+			n.shifts = append(n.shifts, shift{in: in + i + 2, out: len(n.out)})
+		case c == '\\' && i+1 < len(body) && body[i+1] == '\'':
+			n.out = append(n.out, '\'')
+			i++
+			n.shifts = append(n.shifts, shift{in: in + i + 2, out: len(n.out)})
+		case c == '\\' && i+1 < len(body):
+			n.out = append(n.out, c, body[i+1])
+			i++
+		default:
+			n.out = append(n.out, c)
+		}
+	}
+	n.out = append(n.out, '"')
+}
+
+// stringEnd returns the offset following the string quoted with q starting
+// at offset i, or -1 if it is not terminated.
+func stringEnd(data []byte, i int, q byte) int {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case q:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || '0' <= c && c <= '9'
+}
+
+// inputOffset maps an offset of the normalized document back to data.
+func (n *normalizer) inputOffset(out int) int {
+	i := sort.Search(len(n.shifts), func(i int) bool { return n.shifts[i].out > out })
+	if i == 0 {
+		return out
+	}
+	s := n.shifts[i-1]
+	return s.in + out - s.out
+}
+
+func (n *normalizer) mapError(se *SyntaxError) error {
+	e := n.errorAt(n.inputOffset(se.Offset)).(*SyntaxError)
+	e.State, e.Mode = se.State, se.Mode
+	return e
+}
+
+// errorAt reports an unterminated comment or string at the end of data.
+func (n *normalizer) errorAt(offset int) error {
+	return (&scanner{data: n.data}).errorAt(offset)
+}
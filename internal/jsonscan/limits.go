@@ -0,0 +1,37 @@
+package jsonscan
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Limits bound the resources scanning a document takes. Zero means no limit.
+type Limits struct {
+	MaxDepth     int // arrays and objects nested in one another
+	MaxBytes     int // size of the document
+	MaxKeys      int // keys of all the objects of the document
+	MaxStringLen int // bytes of a key or string, escapes as written
+}
+
+var (
+	ErrMaxDepth     = errors.New("maximum depth exceeded")
+	ErrMaxBytes     = errors.New("maximum size exceeded")
+	ErrMaxKeys      = errors.New("maximum number of keys exceeded")
+	ErrMaxStringLen = errors.New("maximum string length exceeded")
+)
+
+// LimitError reports a document exceeding one of its Limits, Err telling
+// which.
+type LimitError struct {
+	Err    error
+	Max    int
+	Offset int // where the limit was exceeded
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("invalid json: %s (%d) at offset %d", e.Err, e.Max, e.Offset)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,132 @@
+package jsonscan
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// PathElem is a step of a path: an object key, or an array index if IsIndex.
+type PathElem struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+type pathFrame struct {
+	isArray bool
+	key     []byte // raw, quotes included
+	index   int
+}
+
+// Extract returns the values at paths in data, or nil for the paths that do
+// not exist, tokenizing data once and skipping the arrays and objects no path
+// leads into. It stops as soon as all the paths are found, so data is only
+// validated up to there.
+func Extract(data []byte, paths [][]PathElem) ([][]byte, error) {
+	values := make([][]byte, len(paths))
+	found := 0
+	open := make(map[int]int64) // paths whose array or object is being scanned
+	var frames []pathFrame
+	t := NewBytesTokenizer(data)
+	done := false
+	for found < len(paths) {
+		tok, err := t.Next()
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			if !done {
+				return nil, t.errorAt(int64(len(data)), utf8.RuneError)
+			}
+			break
+		}
+		if done {
+			// only whitespace may follow the value
+			r, _ := utf8.DecodeRune(data[tok.Start:])
+			return nil, t.errorAt(tok.Start, r)
+		}
+		switch tok.Kind {
+		case Key:
+			frames[len(frames)-1].key = t.Bytes()
+			continue
+		case ObjectEnd, ArrayEnd:
+			frames = frames[:len(frames)-1]
+			for i, start := range open {
+				if len(paths[i]) == len(frames) {
+					values[i] = data[start:tok.End]
+					delete(open, i)
+					found++
+				}
+			}
+		default:
+			for i, path := range paths {
+				if values[i] != nil || !matchPath(path, frames) {
+					continue
+				}
+				if tok.Kind == ObjectBegin || tok.Kind == ArrayBegin {
+					open[i] = tok.Start
+				} else {
+					values[i] = data[tok.Start:tok.End]
+					found++
+				}
+			}
+			if tok.Kind == ObjectBegin || tok.Kind == ArrayBegin {
+				frames = append(frames, pathFrame{isArray: tok.Kind == ArrayBegin})
+				if len(open) > 0 || leadsToPath(paths, values, frames) {
+					continue
+				}
+				if err = t.Skip(); err != nil {
+					return nil, err
+				}
+				frames = frames[:len(frames)-1]
+			}
+		}
+		if len(frames) == 0 {
+			done = true
+		} else if top := &frames[len(frames)-1]; top.isArray {
+			top.index++
+		}
+	}
+	return values, nil
+}
+
+// matchPath reports whether path leads to the value frames are at.
+func matchPath(path []PathElem, frames []pathFrame) bool {
+	if len(path) != len(frames) {
+		return false
+	}
+	for i, elem := range path {
+		if !matchElem(elem, frames[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// leadsToPath reports whether a path not found yet goes through frames.
+func leadsToPath(paths [][]PathElem, values [][]byte, frames []pathFrame) bool {
+	for i, path := range paths {
+		if values[i] != nil || len(path) < len(frames) {
+			continue
+		}
+		// the innermost frame has no key or index yet
+		if matchPath(path[:len(frames)-1], frames[:len(frames)-1]) && path[len(frames)-1].IsIndex == frames[len(frames)-1].isArray {
+			return true
+		}
+	}
+	return false
+}
+
+func matchElem(elem PathElem, f pathFrame) bool {
+	if elem.IsIndex || f.isArray {
+		return elem.IsIndex && f.isArray && elem.Index == f.index
+	}
+	key := f.key[1 : len(f.key)-1]
+	if bytes.IndexByte(key, '\\') < 0 {
+		return string(key) == elem.Key
+	}
+	var s string
+	return json.Unmarshal(f.key, &s) == nil && s == elem.Key
+}
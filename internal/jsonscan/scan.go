@@ -1,6 +1,10 @@
 package jsonscan
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
 
 type Classes = int
 
@@ -197,16 +201,20 @@ var ms = []string{
 }
 
 type scanner struct {
-	pos   int
-	state state
-	data  []byte
-	modes modeStack
+	pos    int
+	state  state
+	data   []byte
+	modes  modeStack
+	limits Limits
+	keys   int
+	array  bool // whether the document is an array, its elements being kept
 }
 
-func newScanner(data []byte) *scanner {
+func newScanner(data []byte, limits Limits) *scanner {
 	s := &scanner{
-		state: GO,
-		data:  data,
+		state:  GO,
+		data:   data,
+		limits: limits,
 	}
 	s.modes.push(MODE_DONE)
 	return s
@@ -243,27 +251,81 @@ func (s modeStack) len() int {
 }
 
 type KV struct {
-	Key   string
-	Value []byte
+	Key    string
+	Value  []byte
+	Offset int // of Value in the document
+}
+
+// SyntaxError describes where and why scanning failed.
+type SyntaxError struct {
+	Offset int  // byte offset of the offending character, or len(data) at end of input
+	Line   int  // 1-based
+	Column int  // 1-based, in bytes
+	Char   rune // offending character, or utf8.RuneError at end of input
+	State  string
+	Mode   string
 }
 
-var je = fmt.Errorf("invalid json")
+func (e *SyntaxError) Error() string {
+	if e.Char == utf8.RuneError {
+		return fmt.Sprintf("invalid json: unexpected end of input at line %d, column %d (offset %d)",
+			e.Line, e.Column, e.Offset)
+	}
+	return fmt.Sprintf("invalid json: unexpected character %q at line %d, column %d (offset %d)",
+		e.Char, e.Line, e.Column, e.Offset)
+}
+
+// errorAt reports a syntax error at the character starting at offset.
+func (s *scanner) errorAt(offset int) error {
+	e := &SyntaxError{
+		Offset: offset,
+		Line:   1 + bytes.Count(s.data[:offset], []byte{'\n'}),
+		Column: offset - bytes.LastIndexByte(s.data[:offset], '\n'),
+		Char:   utf8.RuneError,
+		State:  sn[s.state],
+	}
+	if offset < len(s.data) {
+		e.Char, _ = utf8.DecodeRune(s.data[offset:])
+	}
+	if m := s.modes.top(); int(m) < len(ms) {
+		e.Mode = ms[m]
+	}
+	return e
+}
 
 func (s *scanner) scan() ([]KV, error) {
 	var keyBeg, keyEnd, valBeg, valEnd int
+	var strBeg int
 	var nextClass Classes
 	var kvs []KV
+	if s.limits.MaxBytes > 0 && len(s.data) > s.limits.MaxBytes {
+		return nil, &LimitError{Err: ErrMaxBytes, Max: s.limits.MaxBytes, Offset: s.limits.MaxBytes}
+	}
 	for idx, c := range s.data {
 		if c >= 128 {
 			nextClass = C_ETC
 		} else {
 			nextClass = AsciiClass[int(c)]
 			if nextClass == _E {
-				return nil, je
+				return nil, s.errorAt(idx)
 			}
 		}
 
 		nextState := StateTransitionTable[s.state][nextClass]
+		if s.state == GO && s.array {
+			switch nextClass {
+			case C_LSQRB:
+				nextState = -5
+			case C_LCURB:
+				nextState = _E
+			}
+		}
+		if nextState == ST {
+			switch s.state {
+			case VA, AR, OB, KE:
+				strBeg = idx
+			}
+		}
 
 		if s.modes.len() == 2 {
 			switch s.state {
@@ -271,8 +333,8 @@ func (s *scanner) scan() ([]KV, error) {
 				if nextState == ST {
 					keyBeg = idx
 				}
-			case VA:
-				if nextState != VA {
+			case VA, AR:
+				if nextState != s.state {
 					valBeg = idx
 				}
 			case ZE, IN, FS, E3:
@@ -294,12 +356,16 @@ func (s *scanner) scan() ([]KV, error) {
 			switch nextState {
 			case -9:
 				if !s.modes.pop(MODE_KEY) {
-					return nil, je
+					return nil, s.errorAt(idx)
 				}
 				s.state = OK
 			case -8:
+				if s.modes.len() == 2 && (s.state == ZE || s.state == IN || s.state == FS || s.state == E3) {
+					valEnd = idx
+					kvs = append(kvs, s.getKV(keyBeg, keyEnd, valBeg, valEnd))
+				}
 				if !s.modes.pop(MODE_OBJECT) {
-					return nil, je
+					return nil, s.errorAt(idx)
 				}
 				if s.modes.len() == 2 {
 					valEnd = idx + 1
@@ -307,8 +373,12 @@ func (s *scanner) scan() ([]KV, error) {
 				}
 				s.state = OK
 			case -7:
+				if s.modes.len() == 2 && (s.state == ZE || s.state == IN || s.state == FS || s.state == E3) {
+					valEnd = idx
+					kvs = append(kvs, s.getKV(keyBeg, keyEnd, valBeg, valEnd))
+				}
 				if !s.modes.pop(MODE_ARRAY) {
-					return nil, je
+					return nil, s.errorAt(idx)
 				}
 				if s.modes.len() == 2 {
 					valEnd = idx + 1
@@ -316,15 +386,28 @@ func (s *scanner) scan() ([]KV, error) {
 				}
 				s.state = OK
 			case -6:
+				if err := s.checkDepth(idx); err != nil {
+					return nil, err
+				}
 				s.modes.push(MODE_KEY)
 				s.state = OB
 			case -5:
+				if err := s.checkDepth(idx); err != nil {
+					return nil, err
+				}
 				s.modes.push(MODE_ARRAY)
 				s.state = AR
 			case -4:
+				if err := s.checkString(strBeg, idx); err != nil {
+					return nil, err
+				}
 				switch s.modes.top() {
 				case MODE_KEY:
 					s.state = CO
+					s.keys++
+					if s.limits.MaxKeys > 0 && s.keys > s.limits.MaxKeys {
+						return nil, &LimitError{Err: ErrMaxKeys, Max: s.limits.MaxKeys, Offset: strBeg}
+					}
 					if s.modes.len() == 2 {
 						keyEnd = idx + 1
 					}
@@ -335,13 +418,13 @@ func (s *scanner) scan() ([]KV, error) {
 					}
 					s.state = OK
 				default:
-					return nil, je
+					return nil, s.errorAt(idx)
 				}
 			case -3:
 				switch s.modes.top() {
 				case MODE_OBJECT:
 					if !s.modes.pop(MODE_OBJECT) {
-						return nil, je
+						return nil, s.errorAt(idx)
 					}
 					s.modes.push(MODE_KEY)
 					if s.modes.len() == 2 && (s.state == ZE || s.state == IN || s.state == FS || s.state == E3) {
@@ -350,35 +433,74 @@ func (s *scanner) scan() ([]KV, error) {
 					}
 					s.state = KE
 				case MODE_ARRAY:
+					if s.modes.len() == 2 && (s.state == ZE || s.state == IN || s.state == FS || s.state == E3) {
+						valEnd = idx
+						kvs = append(kvs, s.getKV(keyBeg, keyEnd, valBeg, valEnd))
+					}
 					s.state = VA
 				default:
-					return nil, je
+					return nil, s.errorAt(idx)
 				}
 			case -2:
 				if !s.modes.pop(MODE_KEY) {
-					return nil, je
+					return nil, s.errorAt(idx)
 				}
 				s.modes.push(MODE_OBJECT)
 				s.state = VA
 			default:
-				return nil, je
+				return nil, s.errorAt(idx)
 			}
 		}
 	}
 	ok := s.state == OK && s.modes.pop(MODE_DONE)
 	if !ok {
-		return nil, je
+		return nil, s.errorAt(len(s.data))
 	}
 	return kvs, nil
 }
 
+// checkDepth checks the array or object opening at offset is not nested too
+// deeply.
+func (s *scanner) checkDepth(offset int) error {
+	if s.limits.MaxDepth > 0 && s.modes.len() > s.limits.MaxDepth {
+		return &LimitError{Err: ErrMaxDepth, Max: s.limits.MaxDepth, Offset: offset}
+	}
+	return nil
+}
+
+// checkString checks the length of the key or string between the quotes at
+// offsets beg and end.
+func (s *scanner) checkString(beg, end int) error {
+	if s.limits.MaxStringLen > 0 && end-beg-1 > s.limits.MaxStringLen {
+		return &LimitError{Err: ErrMaxStringLen, Max: s.limits.MaxStringLen, Offset: beg}
+	}
+	return nil
+}
+
 func (s *scanner) getKV(keyBeg, keyEnd, valBeg, valEnd int) KV {
+	if s.array {
+		return KV{Value: s.data[valBeg:valEnd], Offset: valBeg}
+	}
 	return KV{
-		Key:   string(s.data[keyBeg+1 : keyEnd-1]),
-		Value: s.data[valBeg:valEnd],
+		Key:    string(s.data[keyBeg+1 : keyEnd-1]),
+		Value:  s.data[valBeg:valEnd],
+		Offset: valBeg,
 	}
 }
 
 func Scan(data []byte) ([]KV, error) {
-	return newScanner(data).scan()
+	return newScanner(data, Limits{}).scan()
+}
+
+// ScanLimits is Scan failing with a LimitError once data exceeds limits.
+func ScanLimits(data []byte, limits Limits) ([]KV, error) {
+	return newScanner(data, limits).scan()
+}
+
+// ScanArray scans a JSON array instead of an object, returning its elements
+// with no key.
+func ScanArray(data []byte, limits Limits) ([]KV, error) {
+	s := newScanner(data, limits)
+	s.array = true
+	return s.scan()
 }
@@ -0,0 +1,333 @@
+package jsonscan
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+type TokenKind uint8
+
+const (
+	ObjectBegin TokenKind = iota + 1
+	ObjectEnd
+	ArrayBegin
+	ArrayEnd
+	Key
+	String
+	Number
+	True
+	False
+	Null
+)
+
+var tokenKindNames = []string{"", "ObjectBegin", "ObjectEnd", "ArrayBegin", "ArrayEnd", "Key", "String", "Number", "True", "False", "Null"}
+
+func (k TokenKind) String() string {
+	if int(k) < len(tokenKindNames) {
+		return tokenKindNames[k]
+	}
+	return "TokenKind(?)"
+}
+
+// Token is a lexical element of JSON. Depth counts the arrays and objects
+// enclosing it, and Start and End delimit its bytes in the whole input,
+// quotes included for keys and strings.
+type Token struct {
+	Kind       TokenKind
+	Depth      int
+	Start, End int64
+}
+
+const tokenizerBufSize = 4096
+
+// Tokenizer splits a stream of JSON values into tokens, driving the same
+// state machine as Scan. It does not allocate once its buffer is large
+// enough for the longest token.
+type Tokenizer struct {
+	r     io.Reader
+	buf   []byte
+	pos   int   // next byte of buf to scan
+	base  int64 // offset of buf[0] in the input
+	start int64 // start of the token being scanned
+	err   error // error of r, reported once buf is drained
+
+	state state
+	modes modeStack
+
+	line      int
+	lineStart int64
+
+	queue   [2]Token // tokens completed by the last byte scanned
+	pending int
+	last    Token
+}
+
+// NewTokenizer tokenizes r, reading it in chunks.
+func NewTokenizer(r io.Reader) *Tokenizer {
+	t := &Tokenizer{r: r, buf: make([]byte, 0, tokenizerBufSize)}
+	t.reset()
+	return t
+}
+
+// NewBytesTokenizer tokenizes data without copying it.
+func NewBytesTokenizer(data []byte) *Tokenizer {
+	t := &Tokenizer{buf: data, err: io.EOF}
+	t.reset()
+	return t
+}
+
+func (t *Tokenizer) reset() {
+	t.state = VA
+	t.modes = make(modeStack, 1, 16)
+	t.modes[0] = MODE_DONE
+	t.line = 1
+}
+
+// Next returns the next token, or io.EOF after the last complete value.
+func (t *Tokenizer) Next() (Token, error) {
+	for t.pending == 0 {
+		if t.pos == len(t.buf) {
+			if err := t.fill(); err != nil {
+				if err = t.end(err); err != nil {
+					return Token{}, err
+				}
+			}
+			continue
+		}
+		c := t.buf[t.pos]
+		if err := t.step(c); err != nil {
+			return Token{}, err
+		}
+		t.pos++
+		if c == '\n' {
+			t.line++
+			t.lineStart = t.offset()
+		}
+	}
+	t.last = t.queue[0]
+	t.queue[0] = t.queue[1]
+	t.pending--
+	return t.last, nil
+}
+
+// Bytes returns the bytes of the token last returned by Next, which are
+// valid until the next call to Next or Skip.
+func (t *Tokenizer) Bytes() []byte {
+	return t.buf[t.last.Start-t.base : t.last.End-t.base]
+}
+
+// Skip skips the array or object the token last returned by Next begins,
+// or the value following it if it is a key.
+func (t *Tokenizer) Skip() error {
+	depth := t.last.Depth
+	switch t.last.Kind {
+	case Key:
+		tok, err := t.Next()
+		if err != nil {
+			return err
+		}
+		if tok.Kind != ObjectBegin && tok.Kind != ArrayBegin {
+			return nil
+		}
+	case ObjectBegin, ArrayBegin:
+	default:
+		return nil
+	}
+	for {
+		tok, err := t.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = t.errorAt(t.offset(), utf8.RuneError)
+			}
+			return err
+		}
+		if (tok.Kind == ObjectEnd || tok.Kind == ArrayEnd) && tok.Depth == depth {
+			return nil
+		}
+	}
+}
+
+// InputOffset returns the offset of the next byte to scan.
+func (t *Tokenizer) InputOffset() int64 {
+	return t.offset()
+}
+
+func (t *Tokenizer) offset() int64 {
+	return t.base + int64(t.pos)
+}
+
+// fill reads more input, keeping the bytes of the token being scanned.
+func (t *Tokenizer) fill() error {
+	if t.err != nil {
+		return t.err
+	}
+	keep := t.offset()
+	if t.inToken() {
+		keep = t.start
+	}
+	if n := int(keep - t.base); n > 0 {
+		t.buf = t.buf[:copy(t.buf, t.buf[n:])]
+		t.pos -= n
+		t.base = keep
+	}
+	if len(t.buf) == cap(t.buf) {
+		buf := make([]byte, len(t.buf), 2*cap(t.buf)+tokenizerBufSize)
+		copy(buf, t.buf)
+		t.buf = buf
+	}
+	n, err := t.r.Read(t.buf[len(t.buf):cap(t.buf)])
+	t.buf = t.buf[:len(t.buf)+n]
+	if err != nil {
+		t.err = err
+	}
+	if n == 0 {
+		return err
+	}
+	return nil
+}
+
+// end finishes the input, completing a trailing top-level number.
+func (t *Tokenizer) end(err error) error {
+	if err != io.EOF {
+		return err
+	}
+	if t.modes.len() == 1 {
+		switch t.state {
+		case ZE, IN, FS, E3:
+			t.emit(Number, t.start, t.offset())
+			t.state = OK
+			return nil
+		case VA, OK:
+			return io.EOF
+		}
+	}
+	return t.errorAt(t.offset(), utf8.RuneError)
+}
+
+func (t *Tokenizer) inToken() bool {
+	switch t.state {
+	case ST, ES, U1, U2, U3, U4, MI, ZE, IN, FR, FS, E1, E2, E3, T1, T2, T3, F1, F2, F3, F4, N1, N2, N3:
+		return true
+	}
+	return false
+}
+
+func (t *Tokenizer) emit(kind TokenKind, start, end int64) {
+	t.queue[t.pending] = Token{Kind: kind, Depth: t.modes.len() - 1, Start: start, End: end}
+	t.pending++
+}
+
+// step feeds c, at offset pos, to the state machine.
+func (t *Tokenizer) step(c byte) error {
+	pos := t.offset()
+	class := C_ETC
+	if c < 128 {
+		class = AsciiClass[c]
+		if class == _E {
+			return t.errorAt(pos, rune(c))
+		}
+	}
+	// another top-level value may follow a complete one
+	if t.state == OK && t.modes.len() == 1 && class != C_SPACE && class != C_WHITE {
+		t.state = VA
+	}
+
+	next := StateTransitionTable[t.state][class]
+	switch t.state {
+	case ZE, IN, FS, E3:
+		if next == OK || next == -3 || next == -7 || next == -8 {
+			t.emit(Number, t.start, pos)
+		}
+	case T3, F4, N3:
+		if next == OK {
+			t.emit(literalKinds[t.state], t.start, pos+1)
+		}
+	}
+
+	if next >= 0 {
+		switch t.state {
+		case VA, AR, OB, KE:
+			if next != t.state {
+				t.start = pos
+			}
+		}
+		t.state = next
+		return nil
+	}
+	switch next {
+	case -9:
+		if !t.modes.pop(MODE_KEY) {
+			return t.errorAt(pos, rune(c))
+		}
+		t.emit(ObjectEnd, pos, pos+1)
+		t.state = OK
+	case -8:
+		if !t.modes.pop(MODE_OBJECT) {
+			return t.errorAt(pos, rune(c))
+		}
+		t.emit(ObjectEnd, pos, pos+1)
+		t.state = OK
+	case -7:
+		if !t.modes.pop(MODE_ARRAY) {
+			return t.errorAt(pos, rune(c))
+		}
+		t.emit(ArrayEnd, pos, pos+1)
+		t.state = OK
+	case -6:
+		t.emit(ObjectBegin, pos, pos+1)
+		t.modes.push(MODE_KEY)
+		t.state = OB
+	case -5:
+		t.emit(ArrayBegin, pos, pos+1)
+		t.modes.push(MODE_ARRAY)
+		t.state = AR
+	case -4:
+		if t.modes.top() == MODE_KEY {
+			t.emit(Key, t.start, pos+1)
+			t.state = CO
+		} else {
+			t.emit(String, t.start, pos+1)
+			t.state = OK
+		}
+	case -3:
+		switch t.modes.top() {
+		case MODE_OBJECT:
+			t.modes.pop(MODE_OBJECT)
+			t.modes.push(MODE_KEY)
+			t.state = KE
+		case MODE_ARRAY:
+			t.state = VA
+		default:
+			return t.errorAt(pos, rune(c))
+		}
+	case -2:
+		if !t.modes.pop(MODE_KEY) {
+			return t.errorAt(pos, rune(c))
+		}
+		t.modes.push(MODE_OBJECT)
+		t.state = VA
+	default:
+		r := rune(c)
+		if c >= utf8.RuneSelf {
+			r, _ = utf8.DecodeRune(t.buf[t.pos:])
+		}
+		return t.errorAt(pos, r)
+	}
+	return nil
+}
+
+var literalKinds = map[state]TokenKind{T3: True, F4: False, N3: Null}
+
+func (t *Tokenizer) errorAt(offset int64, c rune) error {
+	e := &SyntaxError{
+		Offset: int(offset),
+		Line:   t.line,
+		Column: int(offset-t.lineStart) + 1,
+		Char:   c,
+		State:  sn[t.state],
+	}
+	if m := t.modes.top(); int(m) < len(ms) {
+		e.Mode = ms[m]
+	}
+	return e
+}
@@ -0,0 +1,44 @@
+package dynstruct
+
+// lazyField holds the undecoded JSON of a field of a Value decoded with the
+// Lazy option, until the field is first read.
+type lazyField struct {
+	data []byte
+	opts *DecodeOptions
+}
+
+// load returns the value of the field named name, decoding it first if it
+// is still lazy.
+func (v Value) load(name string) (interface{}, error) {
+	fv := v.value[name]
+	lf, ok := fv.(*lazyField)
+	if !ok {
+		return fv, nil
+	}
+	f, _ := v.t.lookup(name)
+	fv, err := unmarshalField(f, lf.data, lf.opts)
+	if err != nil {
+		return nil, err
+	}
+	v.value[name] = fv
+	return fv, nil
+}
+
+func (v Value) mustLoad(name string) interface{} {
+	fv, err := v.load(name)
+	if err != nil {
+		panic(err)
+	}
+	return fv
+}
+
+// Resolve decodes the fields left undecoded by lazy decoding, which Get
+// would otherwise panic on if they failed to decode.
+func (v Value) Resolve() error {
+	for _, f := range v.t.fields {
+		if _, err := v.load(f.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
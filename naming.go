@@ -0,0 +1,54 @@
+package dynstruct
+
+import (
+	"strings"
+	"unicode"
+)
+
+// SnakeCase names keys like "user_id" after fields like UserID.
+func SnakeCase(name string) string {
+	return joinWords(name, '_')
+}
+
+// KebabCase names keys like "user-id" after fields like UserID.
+func KebabCase(name string) string {
+	return joinWords(name, '-')
+}
+
+// CamelCase names keys like "userID" after fields like UserID.
+func CamelCase(name string) string {
+	rs := []rune(name)
+	n := 0
+	for n < len(rs) && unicode.IsUpper(rs[n]) {
+		n++
+	}
+	// keep the upper case letter starting the next word, as in HTTPServer
+	if n > 1 && n < len(rs) && unicode.IsLower(rs[n]) {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		rs[i] = unicode.ToLower(rs[i])
+	}
+	return string(rs)
+}
+
+// joinWords lower-cases the words of name joined by sep, splitting words
+// before upper case letters following lower case ones or digits, and before
+// the last upper case letter of acronyms followed by lower case letters.
+func joinWords(name string, sep rune) string {
+	rs := []rune(name)
+	var b strings.Builder
+	for i, r := range rs {
+		if r == '_' || r == '-' {
+			r = sep
+		} else if i > 0 && unicode.IsUpper(r) {
+			prev := rs[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				unicode.IsUpper(prev) && i+1 < len(rs) && unicode.IsLower(rs[i+1]) {
+				b.WriteRune(sep)
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,196 @@
+package dynstruct
+
+import (
+	stdjson "encoding/json"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+var (
+	boolType     = reflect.TypeOf(false)
+	intType      = reflect.TypeOf(int(0))
+	int64Type    = reflect.TypeOf(int64(0))
+	uintType     = reflect.TypeOf(uint(0))
+	uint64Type   = reflect.TypeOf(uint64(0))
+	float32Type  = reflect.TypeOf(float32(0))
+	float64Type  = reflect.TypeOf(float64(0))
+	numberType   = reflect.TypeOf(stdjson.Number(""))
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+)
+
+// isJSONNumber reports whether s is a JSON number literal.
+func isJSONNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	if s[0] == '-' {
+		s = s[1:]
+		if s == "" {
+			return false
+		}
+	}
+	switch {
+	case s[0] == '0':
+		s = s[1:]
+	case '1' <= s[0] && s[0] <= '9':
+		s = s[1:]
+		for s != "" && isNumber(rune(s[0])) {
+			s = s[1:]
+		}
+	default:
+		return false
+	}
+	if len(s) >= 2 && s[0] == '.' && isNumber(rune(s[1])) {
+		s = s[2:]
+		for s != "" && isNumber(rune(s[0])) {
+			s = s[1:]
+		}
+	}
+	if len(s) >= 2 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s[0] == '+' || s[0] == '-' {
+			s = s[1:]
+			if s == "" {
+				return false
+			}
+		}
+		for s != "" && isNumber(rune(s[0])) {
+			s = s[1:]
+		}
+	}
+	return s == ""
+}
+
+// parseInteger parses the JSON number s, which may have a fraction or an
+// exponent as long as its value is an integer.
+func parseInteger(s string) (*big.Int, error) {
+	if !isJSONNumber(s) {
+		return nil, strconv.ErrSyntax
+	}
+	if n, ok := new(big.Int).SetString(s, 10); ok {
+		return n, nil
+	}
+	// exponents are bounded to keep 1e1000000000 from taking all the memory
+	f, _, err := big.ParseFloat(s, 10, uint(len(s))*4+64, big.ToNearestEven)
+	if err != nil || f.IsInf() || f.MantExp(nil) > 1<<16 {
+		return nil, strconv.ErrRange
+	}
+	if !f.IsInt() {
+		return nil, makeNotIntegerError()
+	}
+	n, _ := f.Int(nil)
+	return n, nil
+}
+
+func decodeInt(t reflect.Type, data []byte) (interface{}, error) {
+	s := string(data)
+	n, err := strconv.ParseInt(s, 10, t.Bits())
+	if err != nil || !isJSONNumber(s) {
+		bn, perr := parseInteger(s)
+		if perr != nil {
+			return nil, perr
+		}
+		if !bn.IsInt64() {
+			return nil, strconv.ErrRange
+		}
+		n = bn.Int64()
+		if bits := uint(t.Bits()); bits < 64 && (n < -1<<(bits-1) || n >= 1<<(bits-1)) {
+			return nil, strconv.ErrRange
+		}
+	}
+	switch t {
+	case intType:
+		return int(n), nil
+	case int64Type:
+		return n, nil
+	}
+	return reflect.ValueOf(n).Convert(t).Interface(), nil
+}
+
+func decodeUint(t reflect.Type, data []byte) (interface{}, error) {
+	s := string(data)
+	n, err := strconv.ParseUint(s, 10, t.Bits())
+	if err != nil || !isJSONNumber(s) {
+		bn, perr := parseInteger(s)
+		if perr != nil {
+			return nil, perr
+		}
+		if !bn.IsUint64() {
+			return nil, strconv.ErrRange
+		}
+		n = bn.Uint64()
+		if bits := uint(t.Bits()); bits < 64 && n >= 1<<bits {
+			return nil, strconv.ErrRange
+		}
+	}
+	switch t {
+	case uintType:
+		return uint(n), nil
+	case uint64Type:
+		return n, nil
+	}
+	return reflect.ValueOf(n).Convert(t).Interface(), nil
+}
+
+func decodeFloat(t reflect.Type, data []byte) (interface{}, error) {
+	s := string(data)
+	if !isJSONNumber(s) {
+		return nil, strconv.ErrSyntax
+	}
+	f, err := strconv.ParseFloat(s, t.Bits())
+	if err != nil {
+		return nil, err.(*strconv.NumError).Err
+	}
+	switch t {
+	case float64Type:
+		return f, nil
+	case float32Type:
+		return float32(f), nil
+	}
+	return reflect.ValueOf(f).Convert(t).Interface(), nil
+}
+
+// decodeNumber decodes a json.Number from a number literal or from a string
+// holding one, as encoding/json does.
+func decodeNumber(data []byte, opts *DecodeOptions) (interface{}, error) {
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := codecOf(opts.codec).Unmarshal(data, &s, *opts); err != nil {
+			return nil, err
+		}
+	}
+	if !isJSONNumber(s) {
+		return nil, strconv.ErrSyntax
+	}
+	return stdjson.Number(s), nil
+}
+
+func decodeBigInt(data []byte) (interface{}, error) {
+	n, err := parseInteger(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return *n, nil
+}
+
+// decodeBigFloat decodes a big.Float from a number literal, or from a string
+// as it is encoded in, with enough precision to keep all the digits.
+func decodeBigFloat(data []byte, opts *DecodeOptions) (interface{}, error) {
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := codecOf(opts.codec).Unmarshal(data, &s, *opts); err != nil {
+			return nil, err
+		}
+	} else if !isJSONNumber(s) {
+		return nil, strconv.ErrSyntax
+	}
+	prec := uint(math.Ceil(float64(len(s))*math.Log2(10))) + 64
+	f, _, err := big.ParseFloat(s, 10, prec, big.ToNearestEven)
+	if err != nil {
+		return nil, err
+	}
+	return *f, nil
+}
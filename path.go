@@ -0,0 +1,72 @@
+package dynstruct
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/nextzhou/dynstruct/internal/jsonscan"
+)
+
+// parsePath parses a path of dot separated keys, each followed by any number
+// of bracketed array indexes, like "items[0].meta.id". The empty path is the
+// whole value.
+func parsePath(path string) ([]jsonscan.PathElem, error) {
+	var elems []jsonscan.PathElem
+	if path == "" {
+		return elems, nil
+	}
+	for i, seg := range strings.Split(path, ".") {
+		key := seg
+		if j := strings.IndexByte(seg, '['); j >= 0 {
+			key = seg[:j]
+			seg = seg[j:]
+		} else {
+			seg = ""
+		}
+		// only the first segment may start with an index, for top-level arrays
+		if key != "" {
+			elems = append(elems, jsonscan.PathElem{Key: key})
+		} else if i > 0 || seg == "" {
+			return nil, makeInvalidPathError(path)
+		}
+		for seg != "" {
+			end := strings.IndexByte(seg, ']')
+			if seg[0] != '[' || end < 0 {
+				return nil, makeInvalidPathError(path)
+			}
+			index, err := strconv.Atoi(seg[1:end])
+			if err != nil || index < 0 || seg[1] == '+' {
+				return nil, makeInvalidPathError(path)
+			}
+			elems = append(elems, jsonscan.PathElem{Index: index, IsIndex: true})
+			seg = seg[end+1:]
+		}
+	}
+	return elems, nil
+}
+
+// ExtractJSON returns the JSON of the values at paths in data, or nil for
+// the paths data has no value at, without decoding data.
+func ExtractJSON(data []byte, paths ...string) ([][]byte, error) {
+	elems := make([][]jsonscan.PathElem, len(paths))
+	for i, path := range paths {
+		var err error
+		if elems[i], err = parsePath(path); err != nil {
+			return nil, err
+		}
+	}
+	return jsonscan.Extract(data, elems)
+}
+
+// UnmarshalJSONPath decodes the value at path in data into v, leaving the
+// rest of data undecoded.
+func (v *Value) UnmarshalJSONPath(data []byte, path string) error {
+	values, err := ExtractJSON(data, path)
+	if err != nil {
+		return err
+	}
+	if values[0] == nil {
+		return makePathNotFoundError(path)
+	}
+	return v.UnmarshalJSON(values[0])
+}
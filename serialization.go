@@ -2,113 +2,518 @@ package dynstruct
 
 import (
 	"bytes"
+	stdjson "encoding/json"
 	"reflect"
 	"strconv"
 
-	"github.com/json-iterator/go"
 	"github.com/nextzhou/dynstruct/internal/jsonscan"
 )
 
-var json = jsoniter.ConfigCompatibleWithStandardLibrary
+// SyntaxError is returned by UnmarshalJSON for malformed JSON, locating the
+// offending character.
+type SyntaxError = jsonscan.SyntaxError
+
+// LimitError is returned by UnmarshalJSON for JSON exceeding the limits set
+// by DecodeOptions.
+type LimitError = jsonscan.LimitError
+
+var (
+	ErrMaxDepth     = jsonscan.ErrMaxDepth
+	ErrMaxBytes     = jsonscan.ErrMaxBytes
+	ErrMaxKeys      = jsonscan.ErrMaxKeys
+	ErrMaxStringLen = jsonscan.ErrMaxStringLen
+)
 
 func (v Value) MarshalJSON() ([]byte, error) {
+	data, err := v.AppendJSON(nil)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type jsonMember struct {
+	key   string
+	value []byte
+	depth int
+}
+
+// marshalFlattenedJSON inlines the fields of embedded fields like
+// encoding/json does, dropping those hidden by shallower or ambiguous keys.
+func (v Value) marshalFlattenedJSON(st *encodeState) ([]byte, error) {
+	members, err := v.jsonMembers(0, st)
+	if err != nil {
+		return nil, err
+	}
+	members = dominantMembers(members)
+	for _, f := range v.UnknownFields() {
+		members = append(members, jsonMember{key: f.Key, value: f.Value})
+	}
 	buf := bytes.NewBuffer(nil)
 	buf.WriteByte('{')
-	for i, field := range v.t.fields {
+	for i, m := range members {
 		if i > 0 {
 			buf.WriteByte(',')
 		}
 		buf.WriteByte('"')
-		buf.WriteString(field.name)
+		buf.WriteString(m.key)
 		buf.WriteString(`":`)
-		d, err := json.Marshal(v.value[field.name])
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (v Value) jsonMembers(depth int, st *encodeState) ([]jsonMember, error) {
+	members := make([]jsonMember, 0, len(v.t.fields))
+	for _, field := range v.t.fields {
+		fv := v.value[field.name]
+		if field.embedded {
+			inner, err := embeddedJSONMembers(fv, depth+1, st)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, inner...)
+			continue
+		}
+		d, err := encodeField(field, fv, st)
 		if err != nil {
 			return nil, err
 		}
-		buf.Write(d)
+		// keys are kept quoted as they are in the JSON of embedded Go structs
+		q := field.key[:len(field.key)-1]
+		if st.renames(field) {
+			q = appendString(nil, st.keyNaming(field.name), !st.keepHTML)
+		}
+		key := string(q[1 : len(q)-1])
+		members = append(members, jsonMember{key: key, value: d, depth: depth})
 	}
-	buf.WriteByte('}')
-	return buf.Bytes(), nil
+	return members, nil
+}
+
+func encodeField(f field, fv interface{}, st *encodeState) ([]byte, error) {
+	if lf, ok := fv.(*lazyField); ok {
+		return lf.data, nil
+	}
+	return f.encode(nil, f, fv, st)
+}
+
+func embeddedJSONMembers(embed interface{}, depth int, st *encodeState) ([]jsonMember, error) {
+	if ev, ok := embed.(Value); ok {
+		return ev.jsonMembers(depth, st)
+	}
+	d, err := st.marshal(embed)
+	if err != nil {
+		return nil, err
+	}
+	if string(d) == "null" {
+		return nil, nil
+	}
+	kvs, err := jsonscan.Scan(d)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]jsonMember, len(kvs))
+	for i, kv := range kvs {
+		members[i] = jsonMember{key: kv.Key, value: kv.Value, depth: depth}
+	}
+	return members, nil
+}
+
+func dominantMembers(members []jsonMember) []jsonMember {
+	type rank struct {
+		depth, n int
+	}
+	ranks := make(map[string]rank, len(members))
+	for _, m := range members {
+		r, ok := ranks[m.key]
+		switch {
+		case !ok || m.depth < r.depth:
+			ranks[m.key] = rank{depth: m.depth, n: 1}
+		case m.depth == r.depth:
+			r.n++
+			ranks[m.key] = r
+		}
+	}
+	dominant := members[:0]
+	for _, m := range members {
+		if r := ranks[m.key]; r.depth == m.depth && r.n == 1 {
+			dominant = append(dominant, m)
+		}
+	}
+	return dominant
+}
+
+// DecodeOptions make UnmarshalJSON stricter than encoding/json. The options
+// of the DynStruct of the decoded Value apply to the Values nested in it too.
+type DecodeOptions struct {
+	DisallowUnknownFields bool
+	RejectDuplicateKeys   bool
+	RequireAllFields      bool // fields added with Required() are always required
+	UseNumber             bool // decode numbers held by interface{} as json.Number
+	KeyMatching           KeyMatching
+	KeepUnknownFields     bool // keep unknown keys for MarshalJSON to emit them again
+	// Lazy defers decoding the fields until they are first read, which makes
+	// reading Values not safe for concurrent use. MarshalJSON emits fields
+	// never read as they were. Embedded fields are always decoded.
+	Lazy bool
+	// Lenient accepts // and /* */ comments, trailing commas, identifier keys
+	// and single-quoted strings, as hand-edited files have. Decoder ignores it.
+	Lenient bool
+	// Limits guarding against hostile input, zero meaning no limit. Exceeding
+	// one fails with a LimitError wrapping ErrMaxDepth, ErrMaxBytes,
+	// ErrMaxKeys or ErrMaxStringLen.
+	MaxDepth     int
+	MaxBytes     int
+	MaxKeys      int // keys of all the objects of the document
+	MaxStringLen int
+
+	codec Codec // of the DynStruct decoded
+}
+
+func (opts *DecodeOptions) limits() jsonscan.Limits {
+	return jsonscan.Limits{
+		MaxDepth:     opts.MaxDepth,
+		MaxBytes:     opts.MaxBytes,
+		MaxKeys:      opts.MaxKeys,
+		MaxStringLen: opts.MaxStringLen,
+	}
+}
+
+// RawField is a key of a JSON object, as it appears between the quotes, with
+// its undecoded value.
+type RawField struct {
+	Key   string
+	Value []byte
+}
+
+// unknownFieldsKey holds the unknown fields of a Value in its map, no field
+// being named by an empty string.
+const unknownFieldsKey = ""
+
+// UnknownFields returns the keys of the JSON object v was decoded from that
+// are not in its DynStruct, in their original order, if it was decoded with
+// KeepUnknownFields.
+func (v Value) UnknownFields() []RawField {
+	unknown, _ := v.value[unknownFieldsKey].([]RawField)
+	return unknown
 }
 
+// KeyMatching tells how JSON keys are matched against fields, besides the
+// aliases of the fields which are always matched exactly.
+type KeyMatching uint8
+
+const (
+	MatchExact KeyMatching = iota
+	// MatchCaseInsensitive falls back to matching keys case-insensitively
+	// when no key matches exactly, like encoding/json does.
+	MatchCaseInsensitive
+)
+
 func (v *Value) UnmarshalJSON(data []byte) error {
 	if v.t == nil {
 		return makeUnknownTypeError()
 	}
-	kvs, err := jsonscan.Scan(data)
+	return v.decodeJSON(data, &v.t.decodeOpts)
+}
+
+// UnmarshalJSONOptions is UnmarshalJSON with opts instead of the options of
+// the DynStruct of v.
+func (v *Value) UnmarshalJSONOptions(data []byte, opts DecodeOptions) error {
+	if v.t == nil {
+		return makeUnknownTypeError()
+	}
+	opts.codec = v.t.codec
+	return v.decodeJSON(data, &opts)
+}
+
+// decodeJSON decodes a whole document, the Values nested in it being decoded
+// by unmarshalJSON from the document once made strict.
+func (v *Value) decodeJSON(data []byte, opts *DecodeOptions) error {
+	data, opts, err := normalizeJSON(data, opts)
 	if err != nil {
 		return err
 	}
-	for _, field := range v.t.fields {
-		var d []byte
-		// TODO optimize
-		for _, kv := range kvs {
-			if kv.Key == field.name {
-				d = kv.Value
-				break
+	return v.unmarshalJSON(data, opts)
+}
+
+// normalizeJSON makes a lenient document strict, returning the options to
+// decode it with.
+func normalizeJSON(data []byte, opts *DecodeOptions) ([]byte, *DecodeOptions, error) {
+	if !opts.Lenient {
+		return data, opts, nil
+	}
+	data, err := jsonscan.Normalize(data, opts.limits())
+	if err != nil {
+		return nil, nil, err
+	}
+	// Normalize checked the size before quoting keys and strings
+	strict := *opts
+	strict.MaxBytes = 0
+	return data, &strict, nil
+}
+
+func (v *Value) unmarshalJSON(data []byte, opts *DecodeOptions) error {
+	if opts.Lazy {
+		// keep the fields from changes the caller makes to data
+		data = append([]byte(nil), data...)
+	}
+	kvs, err := jsonscan.ScanLimits(data, opts.limits())
+	if err != nil {
+		return err
+	}
+	decoded := make([]bool, len(v.t.fields))
+	var embedded map[string][]jsonscan.KV
+	var seen map[string]bool
+	var unknown []RawField
+	var lazies []lazyField
+	if opts.RejectDuplicateKeys {
+		seen = make(map[string]bool, len(kvs))
+	}
+	for _, kv := range kvs {
+		if seen != nil {
+			if seen[kv.Key] {
+				return makeDuplicateKeyError(v.t, kv.Key)
 			}
+			seen[kv.Key] = true
 		}
-		if len(d) == 0 {
-			v.value[field.name] = v.t.zeroValue.value[field.name]
+		i, ok := v.t.matchKey(kv.Key, opts.KeyMatching)
+		if !ok {
+			if embed, ok := v.t.matchEmbedKey(kv.Key, opts.KeyMatching); ok {
+				if embedded == nil {
+					embedded = make(map[string][]jsonscan.KV)
+				}
+				embedded[embed] = append(embedded[embed], kv)
+			} else if opts.DisallowUnknownFields {
+				return makeUnknownKeyError(v.t, kv.Key)
+			} else if opts.KeepUnknownFields {
+				// data may be reused by the caller, as the Decoder does
+				raw := kv.Value
+				if !opts.Lazy {
+					raw = append([]byte(nil), raw...)
+				}
+				unknown = append(unknown, RawField{Key: kv.Key, Value: raw})
+			}
+			continue
+		}
+		// the first key matching a field wins
+		if decoded[i] {
+			if opts.RejectDuplicateKeys {
+				return makeDuplicateKeyError(v.t, kv.Key)
+			}
 			continue
 		}
-		fv, err := unmarshal(field.t, d)
+		decoded[i] = true
+		field := v.t.fields[i]
+		if opts.Lazy {
+			if lazies == nil {
+				lazies = make([]lazyField, 0, len(kvs))
+			}
+			lazies = append(lazies, lazyField{data: kv.Value, opts: opts})
+			v.value[field.name] = &lazies[len(lazies)-1]
+			continue
+		}
+		fv, err := unmarshalField(field, kv.Value, opts)
 		if err != nil {
 			return err
 		}
 		v.value[field.name] = fv
 	}
+	for i, field := range v.t.fields {
+		if field.embedded {
+			fv, err := unmarshalEmbedded(field, embedded[field.name], opts)
+			if err != nil {
+				return err
+			}
+			v.value[field.name] = fv
+		} else if !decoded[i] {
+			if field.required || opts.RequireAllFields {
+				return makeMissingKeyError(v.t, field.jsonKey)
+			}
+			v.value[field.name] = field.zero()
+		}
+	}
+	if unknown != nil {
+		v.value[unknownFieldsKey] = unknown
+	} else {
+		delete(v.value, unknownFieldsKey)
+	}
 	return nil
 }
 
-func unmarshal(t reflect.Type, data []byte) (interface{}, error) {
+// unmarshalEmbedded decodes the keys owned by the embedded field f into it.
+func unmarshalEmbedded(f field, kvs []jsonscan.KV, opts *DecodeOptions) (interface{}, error) {
+	if len(kvs) == 0 {
+		return f.zero(), nil
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte('{')
+	for i, kv := range kvs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('"')
+		buf.WriteString(kv.Key)
+		buf.WriteString(`":`)
+		buf.Write(kv.Value)
+	}
+	buf.WriteByte('}')
+	return unmarshalField(f, buf.Bytes(), opts)
+}
+
+func unmarshalField(f field, data []byte, opts *DecodeOptions) (interface{}, error) {
+	if f.enum != nil {
+		return f.enum.unmarshal(f.name, data, opts)
+	}
+	if f.union != nil {
+		return f.union.unmarshal(f.name, data, opts)
+	}
+	if f.ds != nil {
+		rv, err := decodeDyn(f.t, f.ds, data, opts)
+		if err != nil {
+			return nil, err
+		}
+		return rv.Interface(), nil
+	}
+	fv, err := unmarshal(f.t, data, opts)
+	if err != nil {
+		return nil, makeFieldDecodeError(f.name, f.t, data, err)
+	}
+	return fv, nil
+}
+
+// decodeDyn decodes data into a value of type t, which holds Values of type
+// ds through pointers, slices and maps.
+func decodeDyn(t reflect.Type, ds *DynStruct, data []byte, opts *DecodeOptions) (reflect.Value, error) {
+	if t == valueType {
+		val := ds.New()
+		if string(data) == "null" {
+			return reflect.ValueOf(val), nil
+		}
+		err := val.unmarshalJSON(data, opts)
+		return reflect.ValueOf(val), err
+	}
+	rv := reflect.New(t).Elem()
+	if string(data) == "null" {
+		return rv, nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem, err := decodeDyn(t.Elem(), ds, data, opts)
+		if err != nil {
+			return rv, err
+		}
+		rv.Set(reflect.New(t.Elem()))
+		rv.Elem().Set(elem)
+	case reflect.Slice:
+		var items []stdjson.RawMessage
+		if err := codecOf(opts.codec).Unmarshal(data, &items, *opts); err != nil {
+			return rv, err
+		}
+		rv.Set(reflect.MakeSlice(t, len(items), len(items)))
+		for i, item := range items {
+			elem, err := decodeDyn(t.Elem(), ds, item, opts)
+			if err != nil {
+				return rv, err
+			}
+			rv.Index(i).Set(elem)
+		}
+	case reflect.Map:
+		var items map[string]stdjson.RawMessage
+		if err := codecOf(opts.codec).Unmarshal(data, &items, *opts); err != nil {
+			return rv, err
+		}
+		rv.Set(reflect.MakeMapWithSize(t, len(items)))
+		for k, item := range items {
+			elem, err := decodeDyn(t.Elem(), ds, item, opts)
+			if err != nil {
+				return rv, err
+			}
+			rv.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), elem)
+		}
+	default:
+		fv, err := unmarshal(t, data, opts)
+		if err != nil {
+			return rv, err
+		}
+		rv.Set(reflect.ValueOf(fv))
+	}
+	return rv, nil
+}
+
+func unmarshal(t reflect.Type, data []byte, opts *DecodeOptions) (interface{}, error) {
+	if string(data) == "null" {
+		return reflect.Zero(t).Interface(), nil
+	}
+	switch t {
+	case numberType:
+		return decodeNumber(data, opts)
+	case bigIntType:
+		return decodeBigInt(data)
+	case bigFloatType:
+		return decodeBigFloat(data, opts)
+	}
+	// types decoding themselves skip the fast paths of their kinds
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface && isUnmarshaler(reflect.PtrTo(t)) {
+		return unmarshalAny(t, data, opts)
+	}
 	switch t.Kind() {
-	case reflect.Int:
-		return strconv.Atoi(string(data))
-	case reflect.Int8:
-		n, err := strconv.ParseInt(string(data), 10, 8)
-		return int8(n), err
-	case reflect.Int16:
-		n, err := strconv.ParseInt(string(data), 10, 16)
-		return int16(n), err
-	case reflect.Int32:
-		n, err := strconv.ParseInt(string(data), 10, 32)
-		return int32(n), err
-	case reflect.Int64:
-		n, err := strconv.ParseInt(string(data), 10, 64)
-		return int64(n), err
-	case reflect.Uint:
-		return strconv.Atoi(string(data))
-	case reflect.Uint8:
-		n, err := strconv.ParseUint(string(data), 10, 8)
-		return uint8(n), err
-	case reflect.Uint16:
-		n, err := strconv.ParseUint(string(data), 10, 16)
-		return uint16(n), err
-	case reflect.Uint32:
-		n, err := strconv.ParseUint(string(data), 10, 32)
-		return uint32(n), err
-	case reflect.Uint64:
-		n, err := strconv.ParseUint(string(data), 10, 64)
-		return uint64(n), err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return decodeInt(t, data)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return decodeUint(t, data)
+	case reflect.Float32, reflect.Float64:
+		return decodeFloat(t, data)
+	case reflect.Bool:
+		var b bool
+		switch string(data) {
+		case "true":
+			b = true
+		case "false":
+		default:
+			return nil, strconv.ErrSyntax
+		}
+		if t == boolType {
+			return b, nil
+		}
+		return reflect.ValueOf(b).Convert(t).Interface(), nil
 	case reflect.String:
-		if bytes.IndexByte(data, byte('\\')) == -1 {
-			l := len(data)
-			return string(data[1 : l-1]), nil
+		if len(data) < 2 || data[0] != '"' {
+			return nil, strconv.ErrSyntax
 		}
 		var s string
-		err := json.Unmarshal(data, &s)
-		return s, err
-	case reflect.Float32:
-		n, err := strconv.ParseFloat(string(data), 32)
-		return float32(n), err
-	case reflect.Float64:
-		return strconv.ParseFloat(string(data), 64)
+		if bytes.IndexByte(data, byte('\\')) == -1 {
+			s = string(data[1 : len(data)-1])
+		} else if err := codecOf(opts.codec).Unmarshal(data, &s, *opts); err != nil {
+			return nil, err
+		}
+		if t == stringType {
+			return s, nil
+		}
+		return reflect.ValueOf(s).Convert(t).Interface(), nil
+	case reflect.Ptr:
+		elem, err := unmarshal(t.Elem(), data, opts)
+		if err != nil {
+			return nil, err
+		}
+		p := reflect.New(t.Elem())
+		if elem != nil {
+			p.Elem().Set(reflect.ValueOf(elem))
+		}
+		return p.Interface(), nil
 	}
+	return unmarshalAny(t, data, opts)
+}
+
+func unmarshalAny(t reflect.Type, data []byte, opts *DecodeOptions) (interface{}, error) {
 	v := reflect.New(t)
-	err := json.Unmarshal(data, v.Interface())
+	err := codecOf(opts.codec).Unmarshal(data, v.Interface(), *opts)
 	if err != nil {
 		return nil, err
 	}
 	return v.Elem().Interface(), nil
 }
+
+func isUnmarshaler(t reflect.Type) bool {
+	return t.Implements(unmarshalerType) || t.Implements(textUnmarshalerType)
+}
@@ -0,0 +1,120 @@
+package dynstruct
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/nextzhou/dynstruct/internal/jsonscan"
+)
+
+// ValueSlice is a list of Values of one DynStruct, encoded as a JSON array.
+type ValueSlice struct {
+	t      *DynStruct
+	values []Value
+}
+
+// NewSlice returns a ValueSlice of the Values of ds, starting with values.
+func (ds *DynStruct) NewSlice(values ...Value) *ValueSlice {
+	s := &ValueSlice{t: ds.self}
+	s.Append(values...)
+	return s
+}
+
+// Append appends values, panicking if one is not a Value of the DynStruct
+// of s. The zero ValueSlice takes the DynStruct of the first Value.
+func (s *ValueSlice) Append(values ...Value) {
+	t := s.t
+	if t == nil && len(values) > 0 {
+		t = values[0].t
+	}
+	for _, v := range values {
+		if v.t != t || v.t == nil {
+			panic(makeUnmatchedElemError(t, v.t))
+		}
+	}
+	s.t = t
+	s.values = append(s.values, values...)
+}
+
+func (s *ValueSlice) Len() int {
+	return len(s.values)
+}
+
+func (s *ValueSlice) At(i int) Value {
+	return s.values[i]
+}
+
+// Values returns the Values of s, which s shares.
+func (s *ValueSlice) Values() []Value {
+	return s.values
+}
+
+// Sort sorts s stably by less.
+func (s *ValueSlice) Sort(less func(a, b Value) bool) {
+	sort.SliceStable(s.values, func(i, j int) bool {
+		return less(s.values[i], s.values[j])
+	})
+}
+
+func (s ValueSlice) MarshalJSON() ([]byte, error) {
+	data, err := s.AppendJSON(nil)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// AppendJSON appends the JSON array of the Values of s to dst.
+func (s ValueSlice) AppendJSON(dst []byte) ([]byte, error) {
+	// the zero ValueSlice has no DynStruct
+	if s.values == nil {
+		return append(dst, "null"...), nil
+	}
+	st := encodeStatePool.Get().(*encodeState)
+	defer encodeStatePool.Put(st)
+	*st = encodeState{codec: s.t.codec}
+	var err error
+	dst = append(dst, '[')
+	for i, v := range s.values {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		if dst, err = v.appendJSON(dst, st); err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+// UnmarshalJSON decodes a JSON array of objects, or null, replacing the
+// Values of s. The array is scanned once, each object then being decoded
+// from its place in data. Errors name the index and offset of the object.
+func (s *ValueSlice) UnmarshalJSON(data []byte) error {
+	if s.t == nil {
+		return makeUnknownTypeError()
+	}
+	data, opts, err := normalizeJSON(data, &s.t.decodeOpts)
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(data)) == "null" {
+		s.values = nil
+		return nil
+	}
+	elems, err := jsonscan.ScanArray(data, opts.limits())
+	if err != nil {
+		return err
+	}
+	values := make([]Value, len(elems))
+	for i, elem := range elems {
+		values[i] = s.t.New()
+		if string(elem.Value) == "null" {
+			continue
+		}
+		if err = values[i].unmarshalJSON(elem.Value, opts); err != nil {
+			return makeDecodeError(i, int64(elem.Offset), err)
+		}
+	}
+	s.values = values
+	return nil
+}
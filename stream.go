@@ -0,0 +1,309 @@
+package dynstruct
+
+import (
+	"bufio"
+	"bytes"
+	stdjson "encoding/json"
+	"io"
+
+	"github.com/nextzhou/dynstruct/internal/jsonscan"
+)
+
+// Encoder writes Values as JSON to an output stream.
+type Encoder struct {
+	w              io.Writer
+	st             encodeState
+	buf            []byte
+	indentBuf      bytes.Buffer
+	prefix, indent string
+	inArray        bool
+	n              int // Values written in the current array
+	canonical      bool
+	canonicalBuf   []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// SetIndent makes the encoder indent each Value like json.Indent does.
+func (e *Encoder) SetIndent(prefix, indent string) {
+	e.prefix = prefix
+	e.indent = indent
+}
+
+// SetEscapeHTML specifies whether <, > and & are escaped in JSON strings,
+// which they are by default.
+func (e *Encoder) SetEscapeHTML(on bool) {
+	e.st.keepHTML = !on
+}
+
+// SetKeyNaming renames the keys of DynStruct fields, nested ones included,
+// with naming instead of using the field names. Keys set with Key are kept.
+func (e *Encoder) SetKeyNaming(naming func(field string) string) {
+	e.st.keyNaming = naming
+}
+
+// SetCanonical makes the encoder write Values as CanonicalJSON does, which
+// are then never indented.
+func (e *Encoder) SetCanonical(on bool) {
+	e.canonical = on
+}
+
+// Encode writes the JSON encoding of v. Outside an array, each Value is
+// followed by a newline, so that successive calls produce NDJSON.
+func (e *Encoder) Encode(v Value) error {
+	var err error
+	e.buf = e.buf[:0]
+	e.st.codec = v.t.codec
+	if e.inArray {
+		if e.n > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		if e.indenting() {
+			e.buf = append(e.buf, '\n')
+			e.buf = append(e.buf, e.prefix...)
+			e.buf = append(e.buf, e.indent...)
+		}
+	}
+	start := len(e.buf)
+	if e.buf, err = v.appendJSON(e.buf, &e.st); err != nil {
+		return err
+	}
+	if e.canonical {
+		if e.canonicalBuf, err = canonicalize(e.canonicalBuf[:0], e.buf[start:], e.st.codec); err != nil {
+			return err
+		}
+		e.buf = append(e.buf[:start], e.canonicalBuf...)
+	} else if e.indenting() {
+		prefix := e.prefix
+		if e.inArray {
+			prefix += e.indent
+		}
+		e.indentBuf.Reset()
+		if err = stdjson.Indent(&e.indentBuf, e.buf[start:], prefix, e.indent); err != nil {
+			return err
+		}
+		e.buf = append(e.buf[:start], e.indentBuf.Bytes()...)
+	}
+	if !e.inArray {
+		e.buf = append(e.buf, '\n')
+	}
+	if _, err = e.w.Write(e.buf); err != nil {
+		return err
+	}
+	if e.inArray {
+		e.n++
+	}
+	return nil
+}
+
+// BeginArray starts a JSON array holding the Values encoded until EndArray,
+// without keeping them in memory.
+func (e *Encoder) BeginArray() error {
+	if e.inArray {
+		return makeRecallError("Encoder.BeginArray()")
+	}
+	if _, err := io.WriteString(e.w, "["); err != nil {
+		return err
+	}
+	e.inArray = true
+	e.n = 0
+	return nil
+}
+
+// EndArray closes the array started by BeginArray, followed by a newline.
+func (e *Encoder) EndArray() error {
+	if !e.inArray {
+		return makeUnopenedArrayError()
+	}
+	e.buf = e.buf[:0]
+	if e.indenting() && e.n > 0 {
+		e.buf = append(e.buf, '\n')
+		e.buf = append(e.buf, e.prefix...)
+	}
+	e.buf = append(e.buf, ']', '\n')
+	if _, err := e.w.Write(e.buf); err != nil {
+		return err
+	}
+	e.inArray = false
+	return nil
+}
+
+func (e *Encoder) indenting() bool {
+	return !e.canonical && (e.prefix != "" || e.indent != "")
+}
+
+// Decoder reads Values of one DynStruct from a stream holding either a JSON
+// array of them or whitespace separated ones, as NDJSON does. MaxBytes and
+// MaxDepth bound each record as it is read; a record exceeding them ends the
+// stream.
+type Decoder struct {
+	t       *DynStruct
+	r       *bufio.Reader
+	dec     *stdjson.Decoder
+	guard   recordGuard
+	raw     stdjson.RawMessage
+	skipped int64 // whitespace skipped before dec started reading
+	inArray bool
+	index   int
+	opts    *DecodeOptions
+	err     error
+}
+
+func (ds *DynStruct) NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{t: ds.self, r: bufio.NewReader(r)}
+}
+
+// SetOptions makes d decode Values with opts instead of the options of its
+// DynStruct.
+func (d *Decoder) SetOptions(opts DecodeOptions) {
+	opts.codec = d.t.codec
+	d.opts = &opts
+}
+
+// More reports whether there is another Value to decode.
+func (d *Decoder) More() bool {
+	if d.start() != nil {
+		return true // let Decode report the error
+	}
+	return d.dec.More() || d.guard.err != nil
+}
+
+// Decode decodes the next Value into v, reusing v if it is already a Value of
+// the DynStruct of d. It returns io.EOF once the stream is exhausted. Errors
+// name the index and byte offset of the record; after a record that is valid
+// JSON but fails to decode, decoding can go on with the next one.
+func (d *Decoder) Decode(v *Value) error {
+	if err := d.start(); err != nil {
+		return err
+	}
+	opts := d.opts
+	if opts == nil {
+		opts = &d.t.decodeOpts
+	}
+	d.guard.limits = opts.limits()
+	if !d.dec.More() {
+		if d.guard.err != nil {
+			return makeDecodeError(d.index, d.offset(), d.guard.err)
+		}
+		if d.inArray {
+			if _, err := d.dec.Token(); err != nil {
+				return makeDecodeError(d.index, d.offset(), err)
+			}
+			d.inArray = false
+		}
+		return io.EOF
+	}
+	if err := d.dec.Decode(&d.raw); err != nil {
+		offset := d.offset()
+		if se, ok := err.(*stdjson.SyntaxError); ok {
+			offset = d.skipped + se.Offset
+		}
+		return makeDecodeError(d.index, offset, err)
+	}
+	index := d.index
+	d.index++
+	if v.t != d.t {
+		*v = d.t.New()
+	}
+	if err := v.unmarshalJSON(d.raw, opts); err != nil {
+		return makeDecodeError(index, d.offset()-int64(len(d.raw)), err)
+	}
+	return nil
+}
+
+// start skips the leading whitespace to tell a top-level array from NDJSON,
+// consuming the opening bracket of the array.
+func (d *Decoder) start() error {
+	if d.dec != nil || d.err != nil {
+		return d.err
+	}
+	for {
+		b, err := d.r.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			d.err = makeDecodeError(0, d.skipped, err)
+			return d.err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			d.inArray = b[0] == '['
+			break
+		}
+		d.r.ReadByte()
+		d.skipped++
+	}
+	d.guard.r = d.r
+	d.dec = stdjson.NewDecoder(&d.guard)
+	if d.inArray {
+		d.guard.base = 1
+		d.dec.Token()
+	}
+	return nil
+}
+
+// recordGuard applies MaxBytes and MaxDepth to the records read through it,
+// which json.Decoder would otherwise buffer whole before they are checked.
+type recordGuard struct {
+	r        io.Reader
+	limits   jsonscan.Limits
+	base     int  // depth of the records, 1 in a top-level array
+	depth    int  // of the arrays and objects open
+	size     int  // of the record read so far
+	inString bool // within a string, where escaped follows a backslash
+	escaped  bool
+	err      error
+}
+
+func (g *recordGuard) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	n, err := g.r.Read(p)
+	for i, c := range p[:n] {
+		if g.depth == g.base && !g.inString && (c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ',') {
+			g.size = 0
+			continue
+		}
+		g.size++
+		if g.limits.MaxBytes > 0 && g.size > g.limits.MaxBytes {
+			g.err = &LimitError{Err: ErrMaxBytes, Max: g.limits.MaxBytes, Offset: g.limits.MaxBytes}
+			return i, g.err
+		}
+		switch {
+		case g.inString:
+			switch {
+			case g.escaped:
+				g.escaped = false
+			case c == '\\':
+				g.escaped = true
+			case c == '"':
+				g.inString = false
+			}
+		case c == '"':
+			g.inString = true
+		case c == '{' || c == '[':
+			g.depth++
+			if g.depth == g.base {
+				// the top-level array holding the records
+				g.size = 0
+			}
+			if g.limits.MaxDepth > 0 && g.depth-g.base > g.limits.MaxDepth {
+				g.err = &LimitError{Err: ErrMaxDepth, Max: g.limits.MaxDepth, Offset: g.size - 1}
+				return i, g.err
+			}
+		case c == '}' || c == ']':
+			g.depth--
+			if g.depth == g.base {
+				g.size = 0
+			}
+		}
+	}
+	return n, err
+}
+
+func (d *Decoder) offset() int64 {
+	return d.skipped + d.dec.InputOffset()
+}
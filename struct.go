@@ -2,46 +2,114 @@ package dynstruct
 
 import (
 	"reflect"
+	"strings"
 )
 
+var valueType = reflect.TypeOf(Value{})
+
 type DynStruct struct {
-	pkg, name  string
-	fullName   string
-	fieldIndex map[string]reflect.Type
-	zeroValue  Value
-	fields     []field
+	self        *DynStruct
+	pkg, name   string
+	fullName    string
+	fieldIndex  map[string]int
+	keyIndex    map[string]int
+	foldIndex   map[string]int // lower-cased keys, for case-insensitive matching
+	promoted    map[string]promotedField
+	zeroValue   Value
+	hasEmbedded bool
+	embedKeys   map[string]string
+	foldEmbeds  map[string]string
+	decodeOpts  DecodeOptions
+	naming      func(string) string
+	codec       Codec
+	fields      []field
 }
 
 type field struct {
-	name string
-	t    reflect.Type
+	name     string
+	t        reflect.Type
+	ds       *DynStruct
+	union    *unionType
+	enum     *enumType
+	embedded bool
+	required bool
+	aliases  []string
+	jsonKey  string // the key of the field in JSON and the other formats
+	keyed    bool   // jsonKey was set with Key, so naming leaves it alone
+	key      []byte
+	encode   encodeFunc
 }
 
 func makeField(name string, t reflect.Type) field {
 	return field{name: name, t: t}
 }
 
+func makeDynField(name string, ds *DynStruct) field {
+	return field{name: name, t: valueType, ds: ds}
+}
+
+func (f field) zero() interface{} {
+	if f.enum != nil {
+		return f.enum.zero()
+	}
+	if f.t == valueType && f.ds != nil {
+		return f.ds.New()
+	}
+	return reflect.New(f.t).Elem().Interface()
+}
+
+// promotedField is a field reachable through an embedded field, like the
+// promoted fields of an embedded Go struct.
+type promotedField struct {
+	embed string
+	t     reflect.Type
+	ds    *DynStruct
+	depth int
+	index []int // only for embedded Go structs
+}
+
+func (ds *DynStruct) finished() bool {
+	return ds != nil && ds.zeroValue.t != nil
+}
+
 func (ds *DynStruct) New() Value {
 	return ds.zeroValue.Copy()
 }
 
 func (ds *DynStruct) newWithoutInit() Value {
 	return Value{
-		t:     ds,
+		t:     ds.self,
 		value: make(map[string]interface{}, len(ds.fields)),
 	}
 }
 
+func (ds *DynStruct) lookup(name string) (field, bool) {
+	i, ok := ds.fieldIndex[name]
+	if !ok {
+		return field{}, false
+	}
+	return ds.fields[i], true
+}
+
 func (ds *DynStruct) NewFromMapStrictly(m map[string]interface{}) (Value, error) {
 	value := ds.New()
-	for field, fv := range m {
-		if t, ok := ds.fieldIndex[field]; ok {
-			if reflect.TypeOf(fv) != t {
-				return value, makeUnmatchedTypeError(ds, field, t, reflect.TypeOf(fv))
+	for name, fv := range m {
+		if f, ok := ds.lookup(name); ok {
+			if !isExactType(f, fv) {
+				return value, makeUnmatchedTypeError(ds, name, f.t, reflect.TypeOf(fv))
+			}
+			value.value[name] = fv
+		} else if _, ok := ds.promoted[name]; ok {
+			if err := value.set(name, fv); err != nil {
+				return value, err
+			}
+		} else if f, ok := ds.matchName(name, m); ok {
+			if !isExactType(f, fv) {
+				return value, makeUnmatchedTypeError(ds, f.name, f.t, reflect.TypeOf(fv))
 			}
-			value.value[field] = fv
-		} else {
-			return value, makeMissingFieldError(ds, field)
+			value.value[f.name] = fv
+		} else if !ds.matchesName(name) {
+			return value, makeMissingFieldError(ds, name)
 		}
 	}
 	return value, nil
@@ -49,20 +117,75 @@ func (ds *DynStruct) NewFromMapStrictly(m map[string]interface{}) (Value, error)
 
 func (ds *DynStruct) NewFromMap(m map[string]interface{}) (Value, error) {
 	value := ds.New()
-	for field, fv := range m {
-		if t, ok := ds.fieldIndex[field]; ok {
-			if reflect.TypeOf(fv) != t {
-				return value, makeUnmatchedTypeError(ds, field, t, reflect.TypeOf(fv))
+	for name, fv := range m {
+		if f, ok := ds.lookup(name); ok {
+			if !isExactType(f, fv) {
+				return value, makeUnmatchedTypeError(ds, name, f.t, reflect.TypeOf(fv))
 			}
-			value.value[field] = fv
+			value.value[name] = fv
+		} else if _, ok := ds.promoted[name]; ok {
+			if err := value.set(name, fv); err != nil {
+				return value, err
+			}
+		} else if f, ok := ds.matchName(name, m); ok {
+			if !isExactType(f, fv) {
+				return value, makeUnmatchedTypeError(ds, f.name, f.t, reflect.TypeOf(fv))
+			}
+			value.value[f.name] = fv
 		}
 	}
 	return value, nil
 }
 
+// matchName matches name, which is not the name of a field, against the
+// aliases of the fields and, if enabled, case-insensitively. A field is not
+// matched when m also holds its exact name.
+func (ds *DynStruct) matchName(name string, m map[string]interface{}) (field, bool) {
+	i, ok := ds.matchKey(name, ds.decodeOpts.KeyMatching)
+	if !ok || ds.fields[i].embedded {
+		return field{}, false
+	}
+	f := ds.fields[i]
+	if _, ok := m[f.name]; ok {
+		return field{}, false
+	}
+	return f, true
+}
+
+// matchesName reports whether name matches a field through its aliases or
+// case-insensitively.
+func (ds *DynStruct) matchesName(name string) bool {
+	_, ok := ds.matchKey(name, ds.decodeOpts.KeyMatching)
+	return ok
+}
+
+// matchKey returns the index of the field the JSON key is decoded into.
+func (ds *DynStruct) matchKey(key string, m KeyMatching) (int, bool) {
+	if i, ok := ds.keyIndex[key]; ok {
+		return i, true
+	}
+	if m == MatchCaseInsensitive {
+		i, ok := ds.foldIndex[strings.ToLower(key)]
+		return i, ok
+	}
+	return 0, false
+}
+
+// matchEmbedKey returns the embedded field owning the JSON key.
+func (ds *DynStruct) matchEmbedKey(key string, m KeyMatching) (string, bool) {
+	if embed, ok := ds.embedKeys[key]; ok {
+		return embed, true
+	}
+	if m == MatchCaseInsensitive {
+		embed, ok := ds.foldEmbeds[strings.ToLower(key)]
+		return embed, ok
+	}
+	return "", false
+}
+
 func (ds *DynStruct) NewFromMapUnsafely(m map[string]interface{}) Value {
 	return Value{
-		t:     ds,
+		t:     ds.self,
 		value: m,
 	}
 }
@@ -70,3 +193,174 @@ func (ds *DynStruct) NewFromMapUnsafely(m map[string]interface{}) Value {
 func (ds DynStruct) String() string {
 	return ds.fullName
 }
+
+// resolvePromoted collects the fields promoted by embedded fields, following
+// the Go rules: a shallower field hides deeper ones, and fields of the same
+// name at the same depth are ambiguous and thus not promoted.
+func (ds *DynStruct) resolvePromoted() {
+	candidates := make(map[string][]promotedField)
+	for _, f := range ds.fields {
+		if !f.embedded {
+			continue
+		}
+		ds.hasEmbedded = true
+		if f.ds != nil {
+			for _, inner := range f.ds.fields {
+				candidates[inner.name] = append(candidates[inner.name],
+					promotedField{embed: f.name, t: inner.t, ds: inner.ds, depth: 1})
+			}
+			for name, inner := range f.ds.promoted {
+				candidates[name] = append(candidates[name],
+					promotedField{embed: f.name, t: inner.t, ds: inner.ds, depth: inner.depth + 1})
+			}
+			continue
+		}
+		st := f.t
+		if st.Kind() == reflect.Ptr {
+			st = st.Elem()
+		}
+		for _, sf := range reflect.VisibleFields(st) {
+			if sf.PkgPath != "" {
+				continue
+			}
+			candidates[sf.Name] = append(candidates[sf.Name],
+				promotedField{embed: f.name, t: sf.Type, depth: len(sf.Index), index: sf.Index})
+		}
+	}
+
+	ds.promoted = make(map[string]promotedField)
+	for name, cs := range candidates {
+		if _, ok := ds.fieldIndex[name]; ok {
+			continue
+		}
+		best, n := cs[0], 1
+		for _, c := range cs[1:] {
+			switch {
+			case c.depth < best.depth:
+				best, n = c, 1
+			case c.depth == best.depth:
+				n++
+			}
+		}
+		if n == 1 {
+			ds.promoted[name] = best
+		}
+	}
+}
+
+// resolveKeys names the keys of the fields and builds the tables
+// UnmarshalJSON dispatches JSON keys with.
+func (ds *DynStruct) resolveKeys() error {
+	ds.keyIndex = make(map[string]int, len(ds.fields))
+	ds.foldIndex = make(map[string]int, len(ds.fields))
+	for i := range ds.fields {
+		f := &ds.fields[i]
+		if f.jsonKey == "" {
+			f.jsonKey = f.name
+			if ds.naming != nil && !f.embedded {
+				f.jsonKey = ds.naming(f.name)
+			}
+		}
+		if f.embedded {
+			continue
+		}
+		if _, ok := ds.keyIndex[f.jsonKey]; ok {
+			return makeRepeatedNameError("key", f.jsonKey)
+		}
+		ds.keyIndex[f.jsonKey] = i
+	}
+	for i, f := range ds.fields {
+		for _, alias := range f.aliases {
+			if _, ok := ds.keyIndex[alias]; ok {
+				return makeRepeatedNameError("key", alias)
+			}
+			ds.keyIndex[alias] = i
+		}
+	}
+	// as with encoding/json, the first field wins among those folding alike
+	for i, f := range ds.fields {
+		if f.embedded {
+			continue
+		}
+		for _, key := range append([]string{f.jsonKey}, f.aliases...) {
+			if _, ok := ds.foldIndex[strings.ToLower(key)]; !ok {
+				ds.foldIndex[strings.ToLower(key)] = i
+			}
+		}
+	}
+	if ds.hasEmbedded {
+		ds.resolveEmbedKeys()
+	}
+	return nil
+}
+
+// resolveEmbedKeys maps every JSON key flattened from embedded fields to the
+// embedded field owning it, following the encoding/json dominance rules.
+func (ds *DynStruct) resolveEmbedKeys() {
+	var members []jsonMember
+	for _, f := range ds.fields {
+		if !f.embedded {
+			members = append(members, jsonMember{key: f.jsonKey})
+			continue
+		}
+		for _, m := range embeddedKeys(f, 1) {
+			m.value = []byte(f.name)
+			members = append(members, m)
+		}
+	}
+	ds.embedKeys = make(map[string]string)
+	ds.foldEmbeds = make(map[string]string)
+	for _, m := range dominantMembers(members) {
+		if m.depth > 0 {
+			ds.embedKeys[m.key] = string(m.value)
+			if _, ok := ds.foldEmbeds[strings.ToLower(m.key)]; !ok {
+				ds.foldEmbeds[strings.ToLower(m.key)] = string(m.value)
+			}
+		}
+	}
+}
+
+func embeddedKeys(f field, depth int) []jsonMember {
+	var members []jsonMember
+	if f.ds != nil {
+		for _, inner := range f.ds.fields {
+			if inner.embedded {
+				members = append(members, embeddedKeys(inner, depth+1)...)
+			} else {
+				members = append(members, jsonMember{key: inner.jsonKey, depth: depth})
+			}
+		}
+		return members
+	}
+	t := f.t
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := tag
+		if i := strings.IndexByte(tag, ','); i >= 0 {
+			name = tag[:i]
+		}
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			members = append(members, embeddedKeys(makeField(ft.Name(), ft), depth+1)...)
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		members = append(members, jsonMember{key: name, depth: depth})
+	}
+	return members
+}
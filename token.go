@@ -0,0 +1,37 @@
+package dynstruct
+
+import (
+	"io"
+
+	"github.com/nextzhou/dynstruct/internal/jsonscan"
+)
+
+type (
+	Tokenizer = jsonscan.Tokenizer
+	Token     = jsonscan.Token
+	TokenKind = jsonscan.TokenKind
+)
+
+const (
+	TokenObjectBegin = jsonscan.ObjectBegin
+	TokenObjectEnd   = jsonscan.ObjectEnd
+	TokenArrayBegin  = jsonscan.ArrayBegin
+	TokenArrayEnd    = jsonscan.ArrayEnd
+	TokenKey         = jsonscan.Key
+	TokenString      = jsonscan.String
+	TokenNumber      = jsonscan.Number
+	TokenTrue        = jsonscan.True
+	TokenFalse       = jsonscan.False
+	TokenNull        = jsonscan.Null
+)
+
+// NewTokenizer tokenizes the JSON values read from r, which may be of any
+// size: only the token being scanned is kept in memory.
+func NewTokenizer(r io.Reader) *Tokenizer {
+	return jsonscan.NewTokenizer(r)
+}
+
+// NewBytesTokenizer tokenizes the JSON values of data without copying it.
+func NewBytesTokenizer(data []byte) *Tokenizer {
+	return jsonscan.NewBytesTokenizer(data)
+}
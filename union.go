@@ -0,0 +1,366 @@
+package dynstruct
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+
+	"github.com/nextzhou/dynstruct/internal/jsonscan"
+)
+
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+type jsonShape uint8
+
+const (
+	shapeAny jsonShape = iota
+	shapeObject
+	shapeArray
+	shapeString
+	shapeNumber
+	shapeBool
+	shapeNull
+)
+
+type variant struct {
+	name  string
+	t     reflect.Type
+	ds    *DynStruct
+	shape jsonShape
+	keys  map[string]bool // nil if any key is accepted
+}
+
+type unionType struct {
+	variants []variant
+	tag      string
+	err      error
+}
+
+// Union returns a field template holding a value of one of the variants,
+// which are Go types or DynStructs. Without a tag, UnmarshalJSON detects
+// the variant from the shape of the JSON value.
+func Union(variants ...interface{}) unionType {
+	if len(variants) == 0 {
+		return unionType{err: makeInvalidVariantError("")}
+	}
+	var u unionType
+	names := make(map[string]bool, len(variants))
+	for _, template := range variants {
+		vt, err := makeVariant(template)
+		if err != nil {
+			return unionType{err: err}
+		}
+		if names[vt.name] {
+			return unionType{err: makeRepeatedNameError("variant", vt.name)}
+		}
+		names[vt.name] = true
+		u.variants = append(u.variants, vt)
+	}
+	return u
+}
+
+// Tagged makes the union encode its variant name under key in the JSON
+// object of the value, which requires every variant to encode as an object.
+func (u unionType) Tagged(key string) unionType {
+	if u.err != nil {
+		return u
+	}
+	for _, vt := range u.variants {
+		if vt.shape != shapeObject {
+			u.err = makeInvalidVariantError(vt.name)
+			return u
+		}
+	}
+	u.tag = key
+	return u
+}
+
+func makeVariant(template interface{}) (variant, error) {
+	if template == nil {
+		return variant{}, makeInvalidVariantError("")
+	}
+	if ds, ok := asDynStruct(template); ok {
+		if ds == nil {
+			return variant{}, makeUnfinishedTypeError("")
+		}
+		return variant{name: ds.name, t: valueType, ds: ds, shape: shapeObject}, nil
+	}
+	t, ok := template.(reflect.Type)
+	if !ok {
+		t = reflect.TypeOf(template)
+	}
+	vt := variant{name: t.Name(), t: t}
+	if vt.name == "" {
+		vt.name = t.String()
+	}
+
+	et := t
+	for et.Kind() == reflect.Ptr {
+		et = et.Elem()
+	}
+	if et.Kind() == reflect.Interface {
+		return vt, nil
+	}
+	d, err := codecOf(nil).Marshal(reflect.New(et).Interface(), true)
+	if err != nil {
+		return vt, nil
+	}
+	vt.shape = shapeOf(d)
+	if vt.shape == shapeObject && et.Kind() == reflect.Struct {
+		vt.keys = make(map[string]bool)
+		for _, m := range embeddedKeys(makeField(et.Name(), et), 0) {
+			vt.keys[m.key] = true
+		}
+	}
+	return vt, nil
+}
+
+func shapeOf(data []byte) jsonShape {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 {
+		return shapeAny
+	}
+	switch data[0] {
+	case '{':
+		return shapeObject
+	case '[':
+		return shapeArray
+	case '"':
+		return shapeString
+	case 't', 'f':
+		return shapeBool
+	case 'n':
+		return shapeNull
+	}
+	return shapeNumber
+}
+
+func (u *unionType) variantOf(val interface{}) (variant, bool) {
+	if vv, ok := val.(Value); ok {
+		for _, vt := range u.variants {
+			if vt.ds != nil && vt.ds == vv.t {
+				return vt, true
+			}
+		}
+		return variant{}, false
+	}
+	t := reflect.TypeOf(val)
+	for _, vt := range u.variants {
+		if vt.ds == nil && vt.t == t {
+			return vt, true
+		}
+	}
+	return variant{}, false
+}
+
+func (u *unionType) matches(val interface{}) bool {
+	if val == nil {
+		return true
+	}
+	_, ok := u.variantOf(val)
+	return ok
+}
+
+func (u *unionType) marshal(val interface{}, st *encodeState) ([]byte, error) {
+	if val == nil {
+		return []byte("null"), nil
+	}
+	vt, _ := u.variantOf(val)
+	var d []byte
+	var err error
+	if vt.ds != nil {
+		d, err = val.(Value).appendJSON(nil, st)
+	} else {
+		d, err = st.marshal(val)
+	}
+	// a nil pointer variant has no object to hold the tag
+	if err != nil || u.tag == "" || string(d) == "null" {
+		return d, err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(d)+len(u.tag)+len(vt.name)+6))
+	buf.WriteByte('{')
+	buf.Write(appendString(nil, u.tag, !st.keepHTML))
+	buf.WriteByte(':')
+	buf.Write(appendString(nil, vt.name, !st.keepHTML))
+	if inner := bytes.TrimSpace(d[1 : len(d)-1]); len(inner) > 0 {
+		buf.WriteByte(',')
+		buf.Write(inner)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (u *unionType) unmarshal(field string, data []byte, opts *DecodeOptions) (interface{}, error) {
+	shape := shapeOf(data)
+	if shape == shapeNull {
+		return nil, nil
+	}
+	if u.tag != "" {
+		return u.unmarshalTagged(field, data, opts)
+	}
+
+	candidates := make([]variant, 0, len(u.variants))
+	for _, vt := range u.variants {
+		if vt.shape == shape || vt.shape == shapeAny {
+			candidates = append(candidates, vt)
+		}
+	}
+	if shape == shapeObject {
+		kvs, err := jsonscan.ScanLimits(data, opts.limits())
+		if err != nil {
+			return nil, err
+		}
+		rankByKeys(candidates, kvs)
+	} else if shape == shapeNumber {
+		rankByNumber(candidates, data)
+	}
+	for _, vt := range candidates {
+		if val, err := unmarshalVariant(vt, data, opts); err == nil {
+			return val, nil
+		}
+	}
+	return nil, makeUnmatchedVariantError(field, shape.String())
+}
+
+func (u *unionType) unmarshalTagged(field string, data []byte, opts *DecodeOptions) (interface{}, error) {
+	kvs, err := jsonscan.ScanLimits(data, opts.limits())
+	if err != nil {
+		return nil, err
+	}
+	var name string
+	for _, kv := range kvs {
+		if kv.Key == u.tag {
+			if err := codecOf(opts.codec).Unmarshal(kv.Value, &name, *opts); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	for _, vt := range u.variants {
+		if vt.name == name {
+			// the tag is no key of the variant
+			return unmarshalVariant(vt, objectWithout(kvs, u.tag), opts)
+		}
+	}
+	return nil, makeUnmatchedVariantError(field, name)
+}
+
+// objectWithout rebuilds the JSON object of kvs without the members of key.
+func objectWithout(kvs []jsonscan.KV, key string) []byte {
+	obj := []byte{'{'}
+	for _, kv := range kvs {
+		if kv.Key == key {
+			continue
+		}
+		if len(obj) > 1 {
+			obj = append(obj, ',')
+		}
+		obj = appendString(obj, kv.Key, false)
+		obj = append(obj, ':')
+		obj = append(obj, kv.Value...)
+	}
+	return append(obj, '}')
+}
+
+// rankByKeys orders object variants so that those knowing all the keys of the
+// object, and then those missing the fewest of their own keys, come first.
+func rankByKeys(candidates []variant, kvs []jsonscan.KV) {
+	type ranked struct {
+		vt               variant
+		unknown, missing int
+	}
+	rs := make([]ranked, len(candidates))
+	for i, vt := range candidates {
+		rs[i].vt = vt
+		keys := vt.keys
+		if vt.ds != nil {
+			keys = make(map[string]bool, len(vt.ds.fields))
+			for _, f := range vt.ds.fields {
+				if !f.embedded {
+					keys[f.jsonKey] = true
+				}
+			}
+			for k := range vt.ds.embedKeys {
+				keys[k] = true
+			}
+		}
+		if keys == nil {
+			continue
+		}
+		matched := 0
+		for _, kv := range kvs {
+			if keys[kv.Key] {
+				matched++
+			} else {
+				rs[i].unknown++
+			}
+		}
+		rs[i].missing = len(keys) - matched
+	}
+	sort.SliceStable(rs, func(i, j int) bool {
+		if rs[i].unknown != rs[j].unknown {
+			return rs[i].unknown < rs[j].unknown
+		}
+		return rs[i].missing < rs[j].missing
+	})
+	for i, r := range rs {
+		candidates[i] = r.vt
+	}
+}
+
+// rankByNumber moves integer variants first for integer literals, which
+// would otherwise be decoded by a float variant declared before them.
+func rankByNumber(candidates []variant, data []byte) {
+	if bytes.ContainsAny(data, ".eE") {
+		return
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return isIntKind(candidates[i].t.Kind()) && !isIntKind(candidates[j].t.Kind())
+	})
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return reflect.Int <= k && k <= reflect.Uintptr
+}
+
+func unmarshalVariant(vt variant, data []byte, opts *DecodeOptions) (interface{}, error) {
+	if vt.ds != nil {
+		val := vt.ds.New()
+		err := val.unmarshalJSON(data, opts)
+		return val, err
+	}
+	return unmarshal(vt.t, data, opts)
+}
+
+func (s jsonShape) String() string {
+	switch s {
+	case shapeObject:
+		return "object"
+	case shapeArray:
+		return "array"
+	case shapeString:
+		return "string"
+	case shapeNumber:
+		return "number"
+	case shapeBool:
+		return "bool"
+	case shapeNull:
+		return "null"
+	}
+	return "any"
+}
+
+// Variant returns the name of the variant held by the union field, or "" if
+// it holds none.
+func (v Value) Variant(field string) string {
+	f, ok := v.t.lookup(field)
+	if !ok {
+		panic(makeMissingFieldError(v.t, field))
+	}
+	if f.union == nil {
+		panic(makeNotUnionError(v.t, field))
+	}
+	vt, _ := f.union.variantOf(v.mustLoad(field))
+	return vt.name
+}
@@ -1,6 +1,7 @@
 package dynstruct
 
 import (
+	"fmt"
 	"reflect"
 )
 
@@ -15,24 +16,159 @@ func (v Value) Copy() Value {
 		value: make(map[string]interface{}, len(v.t.fields)),
 	}
 	for k, v := range v.value {
+		if vv, ok := v.(Value); ok && vv.t != nil {
+			v = vv.Copy()
+		}
 		newVal.value[k] = v
 	}
 	return newVal
 }
 
+// DeepCopy copies v along with every Value it refers to through pointers,
+// slices and maps, preserving shared and cyclic references.
+func (v Value) DeepCopy() Value {
+	return v.deepCopy(make(map[uintptr]interface{}))
+}
+
+func (v Value) deepCopy(copied map[uintptr]interface{}) Value {
+	id := reflect.ValueOf(v.value).Pointer()
+	if c, ok := copied[id]; ok {
+		return c.(Value)
+	}
+	newVal := Value{
+		t:     v.t,
+		value: make(map[string]interface{}, len(v.t.fields)),
+	}
+	copied[id] = newVal
+	for _, f := range v.t.fields {
+		fv := v.value[f.name]
+		if _, ok := fv.(*lazyField); ok {
+			// the undecoded JSON is never modified
+		} else if f.ds != nil && fv != nil {
+			fv = deepCopyDyn(reflect.ValueOf(fv), copied).Interface()
+		}
+		newVal.value[f.name] = fv
+	}
+	if unknown, ok := v.value[unknownFieldsKey]; ok {
+		newVal.value[unknownFieldsKey] = unknown
+	}
+	return newVal
+}
+
+func deepCopyDyn(rv reflect.Value, copied map[uintptr]interface{}) reflect.Value {
+	switch rv.Kind() {
+	case reflect.Struct:
+		return reflect.ValueOf(rv.Interface().(Value).deepCopy(copied))
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return rv
+		}
+		if c, ok := copied[rv.Pointer()]; ok {
+			return reflect.ValueOf(c)
+		}
+		p := reflect.New(rv.Type().Elem())
+		copied[rv.Pointer()] = p.Interface()
+		p.Elem().Set(deepCopyDyn(rv.Elem(), copied))
+		return p
+	case reflect.Slice:
+		if rv.IsNil() {
+			return rv
+		}
+		s := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			s.Index(i).Set(deepCopyDyn(rv.Index(i), copied))
+		}
+		return s
+	case reflect.Map:
+		if rv.IsNil() {
+			return rv
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(iter.Key(), deepCopyDyn(iter.Value(), copied))
+		}
+		return m
+	}
+	return rv
+}
+
 func (v Value) Set(field string, val interface{}) {
-	t, ok := v.t.fieldIndex[field]
+	if err := v.set(field, val); err != nil {
+		panic(err)
+	}
+}
+
+func (v Value) set(name string, val interface{}) error {
+	f, ok := v.t.lookup(name)
 	if !ok {
-		panic(makeMissingFieldError(v.t, field))
+		if p, ok := v.t.promoted[name]; ok {
+			return v.setPromoted(name, p, val)
+		}
+		return makeMissingFieldError(v.t, name)
+	}
+	if f.enum != nil {
+		if val == nil {
+			v.value[name] = f.enum.zero()
+			return nil
+		}
+		member, ok := f.enum.member(val)
+		if !ok {
+			return makeUnknownMemberError(name, fmt.Sprint(val))
+		}
+		v.value[name] = member
+		return nil
 	}
-	if !isMatchedType(t, reflect.TypeOf(val)) {
-		panic(makeUnmatchedTypeError(v.t, field, t, reflect.TypeOf(val)))
+	if f.union != nil {
+		if !f.union.matches(val) {
+			return makeUnmatchedVariantError(name, reflect.TypeOf(val).String())
+		}
+	} else if !isMatchedField(f.t, f.ds, val) {
+		return makeUnmatchedTypeError(v.t, name, f.t, reflect.TypeOf(val))
 	}
 	if val != nil {
-		v.value[field] = val
+		v.value[name] = val
 	} else {
-		v.value[field] = reflect.New(t).Elem().Interface()
+		v.value[name] = f.zero()
 	}
+	return nil
+}
+
+func (v Value) setPromoted(name string, p promotedField, val interface{}) error {
+	if !isMatchedField(p.t, p.ds, val) {
+		return makeUnmatchedTypeError(v.t, name, p.t, reflect.TypeOf(val))
+	}
+	embed := v.value[p.embed]
+	if ev, ok := embed.(Value); ok {
+		return ev.set(name, val)
+	}
+
+	rv := reflect.New(reflect.TypeOf(embed)).Elem()
+	rv.Set(reflect.ValueOf(embed))
+	sv := rv
+	if sv.Kind() == reflect.Ptr {
+		if sv.IsNil() {
+			sv.Set(reflect.New(sv.Type().Elem()))
+		}
+		sv = sv.Elem()
+	}
+	for _, i := range p.index[:len(p.index)-1] {
+		sv = sv.Field(i)
+		if sv.Kind() == reflect.Ptr {
+			if sv.IsNil() {
+				sv.Set(reflect.New(sv.Type().Elem()))
+			}
+			sv = sv.Elem()
+		}
+	}
+	fv := sv.Field(p.index[len(p.index)-1])
+	if val != nil {
+		fv.Set(reflect.ValueOf(val))
+	} else {
+		fv.Set(reflect.Zero(p.t))
+	}
+	v.value[p.embed] = rv.Interface()
+	return nil
 }
 
 func (v Value) UncheckSet(field string, value interface{}) {
@@ -41,27 +177,49 @@ func (v Value) UncheckSet(field string, value interface{}) {
 
 func (v Value) Scan(field string, val interface{}) {
 	// TODO more exact panic message
-	fv, ok := v.value[field]
-	if !ok {
-		panic(makeMissingFieldError(v.t, field))
-	}
+	fv := v.Get(field)
 	reflect.ValueOf(val).Elem().Set(reflect.ValueOf(fv))
 }
 
 func (v Value) UncheckScan(field string, val interface{}) {
-	reflect.ValueOf(val).Elem().Set(reflect.ValueOf(v.value[field]))
+	reflect.ValueOf(val).Elem().Set(reflect.ValueOf(v.mustLoad(field)))
 }
 
 func (v Value) Get(field string) interface{} {
 	fv, ok := v.value[field]
 	if !ok {
+		if p, ok := v.t.promoted[field]; ok {
+			return v.getPromoted(field, p)
+		}
 		panic(makeMissingFieldError(v.t, field))
 	}
+	if _, ok := fv.(*lazyField); ok {
+		return v.mustLoad(field)
+	}
 	return fv
 }
 
+func (v Value) getPromoted(name string, p promotedField) interface{} {
+	embed := v.value[p.embed]
+	if ev, ok := embed.(Value); ok {
+		return ev.Get(name)
+	}
+	sv := reflect.ValueOf(embed)
+	if sv.Kind() == reflect.Ptr {
+		if sv.IsNil() {
+			return reflect.Zero(p.t).Interface()
+		}
+		sv = sv.Elem()
+	}
+	fv, err := sv.FieldByIndexErr(p.index)
+	if err != nil {
+		return reflect.Zero(p.t).Interface()
+	}
+	return fv.Interface()
+}
+
 func (v Value) UncheckGet(field string) interface{} {
-	return v.value[field]
+	return v.mustLoad(field)
 }
 
 func isMatchedType(t, vt reflect.Type) bool {
@@ -76,3 +234,52 @@ func isMatchedType(t, vt reflect.Type) bool {
 	}
 	return false
 }
+
+func isMatchedField(t reflect.Type, ds *DynStruct, val interface{}) bool {
+	if ds == nil {
+		return isMatchedType(t, reflect.TypeOf(val))
+	}
+	if val == nil {
+		return true
+	}
+	return reflect.TypeOf(val) == t && isMatchedDyn(reflect.ValueOf(val), ds)
+}
+
+func isExactType(f field, val interface{}) bool {
+	if f.enum != nil {
+		name, ok := val.(string)
+		_, member := f.enum.byName[name]
+		return ok && member
+	}
+	if f.union != nil {
+		return val != nil && f.union.matches(val)
+	}
+	if reflect.TypeOf(val) != f.t {
+		return false
+	}
+	return f.ds == nil || isMatchedDyn(reflect.ValueOf(val), f.ds)
+}
+
+// isMatchedDyn reports whether every Value held by rv is of type ds.
+func isMatchedDyn(rv reflect.Value, ds *DynStruct) bool {
+	switch rv.Kind() {
+	case reflect.Struct:
+		return rv.Interface().(Value).t == ds
+	case reflect.Ptr:
+		return rv.IsNil() || isMatchedDyn(rv.Elem(), ds)
+	case reflect.Slice:
+		for i := 0; i < rv.Len(); i++ {
+			if !isMatchedDyn(rv.Index(i), ds) {
+				return false
+			}
+		}
+	case reflect.Map:
+		iter := rv.MapRange()
+		for iter.Next() {
+			if !isMatchedDyn(iter.Value(), ds) {
+				return false
+			}
+		}
+	}
+	return true
+}
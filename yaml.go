@@ -0,0 +1,326 @@
+package dynstruct
+
+import (
+	"reflect"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MarshalYAML encodes v as a mapping of its fields in declaration order,
+// keyed as in JSON. The fields of embedded fields are inlined, as are the
+// JSON keys of embedded Go structs.
+func (v Value) MarshalYAML() (interface{}, error) {
+	return v.yamlNode(&encodeState{codec: v.t.codec})
+}
+
+func (v Value) yamlNode(st *encodeState) (*yaml.Node, error) {
+	if err := st.enter(v); err != nil {
+		return nil, err
+	}
+	defer st.leave(v)
+
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	taken := make(map[string]bool, len(v.t.fields))
+	for _, f := range v.t.fields {
+		if !f.embedded {
+			taken[f.jsonKey] = true
+		}
+	}
+	for _, f := range v.t.fields {
+		fv, err := v.load(f.name)
+		if err != nil {
+			return nil, err
+		}
+		vn, err := yamlFieldNode(f, fv, st)
+		if err != nil {
+			return nil, err
+		}
+		if !f.embedded {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f.jsonKey}, vn)
+			continue
+		}
+		// a nil embedded pointer has no keys, and outer keys hide inner ones
+		if vn.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(vn.Content); i += 2 {
+			if key := vn.Content[i].Value; !taken[key] {
+				taken[key] = true
+				node.Content = append(node.Content, vn.Content[i], vn.Content[i+1])
+			}
+		}
+	}
+	return node, nil
+}
+
+func yamlFieldNode(f field, fv interface{}, st *encodeState) (*yaml.Node, error) {
+	if f.enum != nil || f.union != nil || f.embedded && f.ds == nil {
+		data, err := encodeField(f, fv, st)
+		if err != nil {
+			return nil, err
+		}
+		return jsonToYAML(data)
+	}
+	if f.ds != nil {
+		return dynYAMLNode(reflect.ValueOf(fv), st)
+	}
+	return encodeYAML(fv)
+}
+
+// dynYAMLNode is appendDyn for YAML, keeping track of the Values being
+// encoded to report cycles.
+func dynYAMLNode(rv reflect.Value, st *encodeState) (*yaml.Node, error) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		return rv.Interface().(Value).yamlNode(st)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return yamlNull(), nil
+		}
+		return dynYAMLNode(rv.Elem(), st)
+	case reflect.Slice:
+		if rv.IsNil() {
+			return yamlNull(), nil
+		}
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for i := 0; i < rv.Len(); i++ {
+			item, err := dynYAMLNode(rv.Index(i), st)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, item)
+		}
+		return node, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return yamlNull(), nil
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, k := range keys {
+			item, err := dynYAMLNode(rv.MapIndex(k), st)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k.String()}, item)
+		}
+		return node, nil
+	}
+	if !rv.IsValid() {
+		return yamlNull(), nil
+	}
+	return encodeYAML(rv.Interface())
+}
+
+func encodeYAML(v interface{}) (*yaml.Node, error) {
+	node := &yaml.Node{}
+	if err := node.Encode(v); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func yamlNull() *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+}
+
+// jsonToYAML parses JSON, which is YAML, into a node written in block style.
+func jsonToYAML(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	node := doc.Content[0]
+	clearYAMLStyle(node)
+	return node, nil
+}
+
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		clearYAMLStyle(n)
+	}
+}
+
+// UnmarshalYAML decodes a mapping into v, typing each value by the field it
+// is the key of, under the DecodeOptions of the DynStruct of v. Lazy and
+// KeepUnknownFields only apply to JSON. Type mismatches report their line.
+func (v *Value) UnmarshalYAML(node *yaml.Node) error {
+	if v.t == nil {
+		return makeUnknownTypeError()
+	}
+	return v.unmarshalYAML(node, &v.t.decodeOpts)
+}
+
+func (v *Value) unmarshalYAML(node *yaml.Node, opts *DecodeOptions) error {
+	node = resolveYAML(node)
+	if node.Kind != yaml.MappingNode {
+		return makeYAMLTypeError(node, v.t.String())
+	}
+	decoded := make([]bool, len(v.t.fields))
+	var embedded map[string][]*yaml.Node
+	var seen map[string]bool
+	if opts.RejectDuplicateKeys {
+		seen = make(map[string]bool, len(node.Content)/2)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		kn, vn := node.Content[i], node.Content[i+1]
+		key := kn.Value
+		if seen != nil {
+			if seen[key] {
+				return makeDuplicateKeyError(v.t, key)
+			}
+			seen[key] = true
+		}
+		fi, ok := v.t.matchKey(key, opts.KeyMatching)
+		if !ok {
+			if embed, ok := v.t.matchEmbedKey(key, opts.KeyMatching); ok {
+				if embedded == nil {
+					embedded = make(map[string][]*yaml.Node)
+				}
+				embedded[embed] = append(embedded[embed], kn, vn)
+			} else if opts.DisallowUnknownFields {
+				return makeUnknownKeyError(v.t, key)
+			}
+			continue
+		}
+		// the first key matching a field wins
+		if decoded[fi] {
+			if opts.RejectDuplicateKeys {
+				return makeDuplicateKeyError(v.t, key)
+			}
+			continue
+		}
+		decoded[fi] = true
+		field := v.t.fields[fi]
+		fv, err := unmarshalYAMLField(field, vn, opts)
+		if err != nil {
+			return err
+		}
+		v.value[field.name] = fv
+	}
+	for i, field := range v.t.fields {
+		if field.embedded {
+			fv := field.zero()
+			if pairs := embedded[field.name]; pairs != nil {
+				var err error
+				inner := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: pairs[0].Line, Content: pairs}
+				if fv, err = unmarshalYAMLField(field, inner, opts); err != nil {
+					return err
+				}
+			}
+			v.value[field.name] = fv
+		} else if !decoded[i] {
+			if field.required || opts.RequireAllFields {
+				return makeMissingKeyError(v.t, field.jsonKey)
+			}
+			v.value[field.name] = field.zero()
+		}
+	}
+	delete(v.value, unknownFieldsKey)
+	return nil
+}
+
+// resolveYAML returns the node a document or an alias stands for.
+func resolveYAML(node *yaml.Node) *yaml.Node {
+	for {
+		switch {
+		case node.Kind == yaml.DocumentNode && len(node.Content) == 1:
+			node = node.Content[0]
+		case node.Kind == yaml.AliasNode:
+			node = node.Alias
+		default:
+			return node
+		}
+	}
+}
+
+func isYAMLNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null"
+}
+
+func unmarshalYAMLField(f field, node *yaml.Node, opts *DecodeOptions) (interface{}, error) {
+	node = resolveYAML(node)
+	if f.enum != nil || f.union != nil || f.embedded && f.ds == nil {
+		// these are decoded from their JSON form
+		var x interface{}
+		if err := node.Decode(&x); err != nil {
+			return nil, makeYAMLError(node, err)
+		}
+		data, err := codecOf(opts.codec).Marshal(x, true)
+		if err != nil {
+			return nil, makeYAMLError(node, err)
+		}
+		fv, err := unmarshalField(f, data, opts)
+		if err != nil {
+			return nil, makeYAMLError(node, err)
+		}
+		return fv, nil
+	}
+	if f.ds != nil {
+		rv, err := decodeDynYAML(f.t, f.ds, node, opts)
+		if err != nil {
+			return nil, err
+		}
+		return rv.Interface(), nil
+	}
+	rv := reflect.New(f.t)
+	if err := node.Decode(rv.Interface()); err != nil {
+		return nil, makeYAMLFieldError(node, f.name, f.t, err)
+	}
+	return rv.Elem().Interface(), nil
+}
+
+// decodeDynYAML is decodeDyn for YAML.
+func decodeDynYAML(t reflect.Type, ds *DynStruct, node *yaml.Node, opts *DecodeOptions) (reflect.Value, error) {
+	if t == valueType {
+		val := ds.New()
+		if isYAMLNull(node) {
+			return reflect.ValueOf(val), nil
+		}
+		err := val.unmarshalYAML(node, opts)
+		return reflect.ValueOf(val), err
+	}
+	rv := reflect.New(t).Elem()
+	if isYAMLNull(node) {
+		return rv, nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem, err := decodeDynYAML(t.Elem(), ds, node, opts)
+		if err != nil {
+			return rv, err
+		}
+		rv.Set(reflect.New(t.Elem()))
+		rv.Elem().Set(elem)
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return rv, makeYAMLTypeError(node, t.String())
+		}
+		rv.Set(reflect.MakeSlice(t, len(node.Content), len(node.Content)))
+		for i, item := range node.Content {
+			elem, err := decodeDynYAML(t.Elem(), ds, resolveYAML(item), opts)
+			if err != nil {
+				return rv, err
+			}
+			rv.Index(i).Set(elem)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return rv, makeYAMLTypeError(node, t.String())
+		}
+		rv.Set(reflect.MakeMapWithSize(t, len(node.Content)/2))
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			elem, err := decodeDynYAML(t.Elem(), ds, resolveYAML(node.Content[i+1]), opts)
+			if err != nil {
+				return rv, err
+			}
+			rv.SetMapIndex(reflect.ValueOf(node.Content[i].Value).Convert(t.Key()), elem)
+		}
+	default:
+		return rv, makeYAMLTypeError(node, t.String())
+	}
+	return rv, nil
+}